@@ -7,8 +7,22 @@
 package sparsebitset
 
 import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
 	"math"
+	"math/big"
 	"math/rand"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -298,6 +312,27 @@ func TestCloneEquality(t *testing.T) {
 	}
 }
 
+func TestCloneIndependence(t *testing.T) {
+	v := New(1000)
+	v.Set(1)
+	v.Set(100)
+	v.Set(1000)
+	u := v.Clone()
+	u.Set(2)
+	u.Clear(100)
+	u.Set(1 << 20)
+	if v.Test(2) || !v.Test(100) || v.Test(1<<20) {
+		t.Errorf("Mutating the clone should not change the original, but it does.")
+	}
+	if v.Cardinality() != 3 {
+		t.Errorf("Expected original cardinality 3, got %d", v.Cardinality())
+	}
+	v.Clear(1)
+	if !u.Test(1) {
+		t.Errorf("Mutating the original should not change the clone, but it does.")
+	}
+}
+
 func TestCloneEquality2(t *testing.T) {
 	v := New(1000)
 	v.Set(1)
@@ -601,6 +636,51 @@ func TestPanicAlltBNil(t *testing.T) {
 	b.All()
 }
 
+func TestAll(t *testing.T) {
+	if !New(0).All() {
+		t.Errorf("An empty set should vacuously have all its bits set")
+	}
+
+	// Solid prefixes [0, n], across word boundaries.
+	for _, n := range []uint64{0, 1, 31, 62, 63, 64, 65, 127, 128, 200, 1000} {
+		v := New(0).SetRange(0, n+1)
+		if !v.All() {
+			t.Errorf("A solid prefix [0, %d] should have all its bits set", n)
+		}
+
+		// A hole anywhere in the prefix, below its highest bit.
+		for _, h := range []uint64{0, n / 2, n - 1} {
+			if h >= n {
+				continue
+			}
+			if u := v.Clone().Clear(h); u.All() {
+				t.Errorf("A prefix [0, %d] with a hole at %d should not have all its bits set", n, h)
+			}
+		}
+
+		// A bit set beyond the prefix leaves a gap.
+		if u := v.Clone().Set(n + 2); u.All() {
+			t.Errorf("A prefix [0, %d] with %d set should not have all its bits set", n, n+2)
+		}
+		if u := v.Clone().Set(n + 64*3); u.All() {
+			t.Errorf("A prefix [0, %d] with %d set should not have all its bits set", n, n+64*3)
+		}
+	}
+
+	// Sets whose first block does not start at offset 0.
+	for _, v := range []*BitSet{
+		New(0).Set(64),
+		New(0).SetRange(64, 128),
+		New(0).SetRange(64, 1000),
+		New(0).SetRange(1, 64),
+		New(0).Set(1 << 20),
+	} {
+		if v.All() {
+			t.Errorf("A set starting at %v should not have all its bits set", v.set[0])
+		}
+	}
+}
+
 func TestEqual(t *testing.T) {
 	a := New(100)
 	// b := New(99)
@@ -677,6 +757,26 @@ func TestInPlaceUnion(t *testing.T) {
 	}
 }
 
+func TestInPlaceUnionInterleaved(t *testing.T) {
+	a, b := New(0), New(0)
+	for i := uint64(0); i < 64; i++ {
+		if i%3 == 0 {
+			a.Set(i * 64)
+		} else {
+			b.Set(i*64 + 1)
+		}
+	}
+	b.Set(0)
+	want := a.Union(b)
+	a.InPlaceUnion(b)
+	if !a.Equal(want) {
+		t.Errorf("In-place union should match Union, but does not")
+	}
+	if a.Cardinality() != want.Cardinality() {
+		t.Errorf("Expected cardinality %d, got %d", want.Cardinality(), a.Cardinality())
+	}
+}
+
 func TestIntersection(t *testing.T) {
 	a := New(100)
 	b := New(200)
@@ -918,81 +1018,3926 @@ func TestIsSuperSet(t *testing.T) {
 	}
 }
 
-// BENCHMARKS
-
-func BenchmarkSet(b *testing.B) {
-	b.StopTimer()
+func TestApplyOps(t *testing.T) {
 	r := rand.New(rand.NewSource(0))
-	sz := 100000
-	s := New(uint64(sz))
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		s.Set(uint64(r.Int31n(int32(sz))))
+	a := New(10000)
+	for i := 0; i < 500; i++ {
+		a.Set(uint64(r.Int63n(10000)))
+	}
+
+	ops := make([]Op, 0, 1000)
+	idx := uint64(0)
+	for i := 0; i < 1000; i++ {
+		idx += uint64(r.Int63n(20))
+		ops = append(ops, Op{idx, r.Intn(2) == 0})
+	}
+
+	b := a.Clone()
+	for _, op := range ops {
+		b.SetTo(op.Index, op.Value)
+	}
+	a.ApplyOps(ops)
+	if !a.Equal(b) {
+		t.Errorf("ApplyOps should match applying each operation individually")
+	}
+	for _, el := range a.set {
+		if el.Bits == 0 {
+			t.Errorf("ApplyOps should not leave empty blocks; offset %d", el.Offset)
+		}
+	}
+
+	c := New(100).Set(10)
+	c.ApplyOps([]Op{{10, false}, {10, true}, {70, true}, {70, false}})
+	if c.Test(10) != true || c.Test(70) != false || c.Count() != 1 {
+		t.Errorf("The last operation on an index should win")
+	}
+
+	if New(100).ApplyOps([]Op{{20, true}, {10, true}}) != nil {
+		t.Errorf("ApplyOps should reject unsorted operations")
 	}
 }
 
-func BenchmarkGetTest(b *testing.B) {
-	b.StopTimer()
+func TestWindowChecksums(t *testing.T) {
+	a := New(100000)
+	b := New(100000)
+	for i := uint64(64 * 100); i < 64*300; i += 7 { // shared region
+		a.Set(i)
+		b.Set(i)
+	}
+	a.Set(10)
+	b.Set(11)
+	a.Set(64*400 + 1)
+	b.Set(64*400 + 2)
+
+	ca := a.WindowChecksums(100)
+	cb := b.WindowChecksums(100)
+	if len(ca) != 4 || len(cb) != 4 {
+		t.Fatalf("Expected 4 non-empty windows, but got %d and %d", len(ca), len(cb))
+	}
+	for k, w := range []uint64{0, 1, 2, 4} {
+		if ca[k].Window != w || cb[k].Window != w {
+			t.Errorf("Expected window %d, but got %d and %d", w, ca[k].Window, cb[k].Window)
+		}
+	}
+	if ca[1] != cb[1] || ca[2] != cb[2] {
+		t.Errorf("Windows over the shared region should have matching checksums")
+	}
+	if ca[0] == cb[0] || ca[3] == cb[3] {
+		t.Errorf("Windows over differing regions should not have matching checksums")
+	}
+
+	if cs := New(0).Set(1 << 40).WindowChecksums(1); len(cs) != 1 || cs[0].Window != 1<<40>>6 {
+		t.Errorf("Expected a single window for a single high bit, but got %v", cs)
+	}
+
+	if a.WindowChecksums(0) != nil || New(0).WindowChecksums(10) != nil {
+		t.Errorf("Zero-sized windows and empty sets should have no checksums")
+	}
+}
+
+func TestInsertGrowth(t *testing.T) {
+	var a blockAry
+	n := 10000
+	allocs := 0
+	for i := 0; i < n; i++ {
+		c := cap(a)
+		// Always insert in the middle.
+		a, _ = a.insert(block{uint64(i), 1}, uint32(len(a)/2))
+		if cap(a) != c {
+			allocs++
+		}
+	}
+	if len(a) != n {
+		t.Fatalf("Expected %d blocks, but found %d", n, len(a))
+	}
+	if allocs > 40 {
+		t.Errorf("Capacity should grow geometrically, but grew %d times", allocs)
+	}
+
+	seen := make(map[uint64]bool, n)
+	for _, el := range a {
+		seen[el.Offset] = true
+	}
+	if len(seen) != n {
+		t.Errorf("Insertion lost blocks: %d of %d survive", len(seen), n)
+	}
+
+	v := New(0)
+	for _, i := range []uint64{64 * 10, 64 * 30, 64 * 20, 64 * 0, 64 * 40, 64 * 25} {
+		v.Set(i + 1)
+	}
+	for i, el := range v.set {
+		if i > 0 && v.set[i-1].Offset >= el.Offset {
+			t.Errorf("Blocks should be in ascending order of offsets")
+		}
+	}
+	if v.Count() != 6 {
+		t.Errorf("Count should be 6, but is %d", v.Count())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := New(1000)
+	b := New(1000)
+	for i := uint64(1); i < 200; i++ {
+		a.Set(i)
+	}
+	for i := uint64(150); i < 300; i++ {
+		b.Set(i)
+	}
+	b.Set(1000)
+
+	d := a.Diff(b)
+	if d.Common != 50 {
+		t.Errorf("Common should be 50, but is %d", d.Common)
+	}
+	if len(d.OnlyInB) != 149 || d.OnlyInB[0] != 1 || d.OnlyInB[148] != 149 {
+		t.Errorf("OnlyInB is wrong: %v", d.OnlyInB)
+	}
+	if len(d.OnlyInC) != 101 || d.OnlyInC[0] != 200 || d.OnlyInC[100] != 1000 {
+		t.Errorf("OnlyInC is wrong: %v", d.OnlyInC)
+	}
+	if d.Truncated {
+		t.Errorf("Report should not be truncated")
+	}
+
+	old := DiffLimit
+	DiffLimit = 10
+	defer func() { DiffLimit = old }()
+	d = a.Diff(b)
+	if len(d.OnlyInB) != 10 || len(d.OnlyInC) != 10 || !d.Truncated {
+		t.Errorf("Report should be capped at DiffLimit")
+	}
+	if d.Common != 50 {
+		t.Errorf("Common should be 50 even when capped, but is %d", d.Common)
+	}
+
+	d = a.Diff(nil)
+	if d.Common != 0 || len(d.OnlyInC) != 0 || len(d.OnlyInB) != 10 {
+		t.Errorf("A nil argument should be treated as an empty set")
+	}
+}
+
+// setBits collects the indices of the bits set in the given bitset.
+func setBits(b *BitSet) []uint64 {
+	res := []uint64{}
+	for i, e := b.NextSet(0); e; i, e = b.NextSet(i + 1) {
+		res = append(res, i)
+	}
+	return res
+}
+
+func TestIteratorOverRuns(t *testing.T) {
 	r := rand.New(rand.NewSource(0))
-	sz := 100000
-	s := New(uint64(sz))
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		s.Test(uint64(r.Int31n(int32(sz))))
+	v := New(100000)
+	for k := 0; k < 50; k++ {
+		lo := uint64(r.Int63n(100000))
+		hi := lo + uint64(r.Int63n(1000))
+		for i := lo; i < hi; i++ {
+			v.Set(i)
+		}
+	}
+	for i := uint64(0); i < 64*3; i++ {
+		v.Set(i)
+	}
+	v.Set(64 * 4)
+
+	res := []uint64{}
+	prev := uint64(0)
+	it := v.IteratorOverRuns()
+	for start, end, ok := it.Next(); ok; start, end, ok = it.Next() {
+		if start >= end {
+			t.Fatalf("Empty run [%d, %d)", start, end)
+		}
+		if len(res) > 0 && start <= prev {
+			t.Fatalf("Runs should be maximal and ascending; [%d, %d) after %d", start, end, prev)
+		}
+		for i := start; i < end; i++ {
+			res = append(res, i)
+		}
+		prev = end
+	}
+
+	exp := setBits(v)
+	if len(res) != len(exp) {
+		t.Fatalf("Runs cover %d bits, but %d are set", len(res), len(exp))
+	}
+	for i := range exp {
+		if res[i] != exp[i] {
+			t.Fatalf("Runs differ from set bits at %d: %d != %d", i, res[i], exp[i])
+		}
+	}
+
+	if _, _, ok := New(0).IteratorOverRuns().Next(); ok {
+		t.Errorf("An empty set should have no runs")
 	}
 }
 
-func BenchmarkSetExpand(b *testing.B) {
-	b.StopTimer()
-	sz := uint64(100000)
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		var s BitSet
-		s.Set(sz)
+func TestByteBitmap(t *testing.T) {
+	v := New(1000)
+	v.Set(0).Set(9).Set(63).Set(64).Set(100).Set(130).Set(131).Set(500)
+
+	buf := v.ToByteBitmap(131)
+	if len(buf) != 17 {
+		t.Fatalf("Bitmap should have 17 bytes, but has %d", len(buf))
+	}
+	for _, i := range []uint64{0, 9, 63, 64, 100, 130} {
+		if buf[i/8]&(1<<(i%8)) == 0 {
+			t.Errorf("Bit %d should be set in the bitmap", i)
+		}
+	}
+	if buf[16] != 1<<2 {
+		t.Errorf("Partial final byte should be %#x, but is %#x", 1<<2, buf[16])
+	}
+
+	u := FromByteBitmap(buf)
+	exp := New(1000).Set(0).Set(9).Set(63).Set(64).Set(100).Set(130)
+	if !u.Equal(exp) {
+		t.Errorf("Round trip should drop only the bits beyond the length; got %v", setBits(u))
+	}
+
+	u = FromByteBitmap(v.ToByteBitmap(1024))
+	if !u.Equal(v) {
+		t.Errorf("Round trip should preserve all the bits within the length")
+	}
+
+	if len(New(0).ToByteBitmap(0)) != 0 || FromByteBitmap(nil).Count() != 0 {
+		t.Errorf("Empty bitmaps should map to empty sets")
 	}
 }
 
-// go test -bench=Count
-func BenchmarkCount(b *testing.B) {
-	b.StopTimer()
-	s := New(100000)
-	for i := 0; i < 100000; i += 100 {
-		s.Set(uint64(i))
+func TestJaccard(t *testing.T) {
+	a := New(1000)
+	b := New(1000)
+	for i := uint64(0); i < 100; i++ {
+		a.Set(i)
 	}
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		s.Count()
+	for i := uint64(50); i < 150; i++ {
+		b.Set(i)
+	}
+	j, err := a.Jaccard(b)
+	if err != nil || j != 50.0/150.0 {
+		t.Errorf("Jaccard should be 1/3, but is %f", j)
+	}
+	j, _ = New(0).Jaccard(New(0))
+	if j != 1 {
+		t.Errorf("Jaccard of two empty sets should be 1, but is %f", j)
+	}
+	if _, err = a.Jaccard(nil); err != ErrNilArgument {
+		t.Errorf("Jaccard should fail for a nil argument")
+	}
+
+	if !a.JaccardAtLeast(b, 0.2) {
+		t.Errorf("Similarity is clearly above 0.2")
+	}
+	if a.JaccardAtLeast(b, 0.8) {
+		t.Errorf("Similarity is clearly below 0.8")
+	}
+	if !a.JaccardAtLeast(b, 50.0/150.0) {
+		t.Errorf("Similarity is exactly at the threshold")
+	}
+	if a.JaccardAtLeast(b, 50.0/150.0+1e-9) {
+		t.Errorf("Similarity is just below the threshold")
+	}
+	if a.JaccardAtLeast(New(0).Set(1), 0.5) {
+		t.Errorf("Cardinalities alone rule the threshold out")
+	}
+	if a.JaccardAtLeast(nil, 0) {
+		t.Errorf("JaccardAtLeast should be false for a nil argument")
+	}
+
+	r := rand.New(rand.NewSource(0))
+	for k := 0; k < 200; k++ {
+		c := New(1000)
+		d := New(1000)
+		for i := 0; i < 100; i++ {
+			c.Set(uint64(r.Int63n(1000)))
+			d.Set(uint64(r.Int63n(1000)))
+		}
+		th := r.Float64() / 4
+		j, _ := c.Jaccard(d)
+		if c.JaccardAtLeast(d, th) != (j >= th) {
+			t.Errorf("JaccardAtLeast(%f) disagrees with Jaccard %f", th, j)
+		}
 	}
 }
 
-// go test -bench=Iterate
-func BenchmarkIterate(b *testing.B) {
-	b.StopTimer()
-	s := New(10000)
-	for i := 0; i < 10000; i += 3 {
-		s.Set(uint64(i))
+func TestUnionReaders(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	sets := make([]*BitSet, 3)
+	bufs := make([]*bytes.Buffer, 3)
+	for k := range sets {
+		sets[k] = New(100000)
+		for i := 0; i < 1000; i++ {
+			sets[k].Set(uint64(r.Int63n(100000)))
+		}
+		bufs[k] = new(bytes.Buffer)
+		sets[k].WriteTo(bufs[k])
 	}
-	b.StartTimer()
-	for j := 0; j < b.N; j++ {
-		c := uint(0)
-		for i, e := s.NextSet(0); e; i, e = s.NextSet(i + 1) {
-			c++
+	exp := UnionMany(sets...)
+
+	readers := func() []io.Reader {
+		rs := make([]io.Reader, len(bufs))
+		for k := range bufs {
+			rs[k] = bytes.NewReader(bufs[k].Bytes())
 		}
+		return rs
+	}
+
+	out := new(bytes.Buffer)
+	if err := UnionReaders(out, readers()...); err != nil {
+		t.Fatalf("UnionReaders failed: %v", err)
+	}
+	out.WriteString("trailer")
+	u := New(0).Set(7)
+	if _, err := u.ReadBlocksFrom(out); err != nil || !u.Equal(exp) {
+		t.Errorf("UnionReaders should write the union of the given sets: %v", err)
+	}
+	if out.String() != "trailer" {
+		t.Errorf("ReadBlocksFrom should not read beyond the terminating block")
+	}
+
+	// The output can be merged again, along with other formats.
+	extra := New(0).Set(1 << 40)
+	var merged, more bytes.Buffer
+	UnionReaders(&merged, readers()...)
+	extra.WriteBlocksTo(&more)
+	out.Reset()
+	if err := UnionReaders(out, &merged, &more); err != nil {
+		t.Fatalf("UnionReaders of its own output failed: %v", err)
+	}
+	if w, err := ReadAuto(out); err != nil || !w.Equal(exp.Union(extra)) {
+		t.Errorf("UnionReaders should merge its own output: %v", err)
+	}
+
+	bad := new(bytes.Buffer)
+	(&BitSet{set: blockAry{{5, 1}, {2, 1}}}).WriteTo(bad)
+	if err := UnionReaders(new(bytes.Buffer), bad); err != ErrBlocksOutOfOrder {
+		t.Errorf("UnionReaders should reject unsorted blocks, but answered %v", err)
+	}
+	short := bytes.NewReader(bufs[0].Bytes()[:20])
+	if err := UnionReaders(new(bytes.Buffer), short); err != io.ErrUnexpectedEOF {
+		t.Errorf("UnionReaders should reject truncated data, but answered %v", err)
+	}
+	if err := UnionReaders(new(bytes.Buffer), strings.NewReader("hello world")); err != ErrBadMagic {
+		t.Errorf("UnionReaders should reject unknown data, but answered %v", err)
 	}
 }
 
-// go test -bench=SparseIterate
-func BenchmarkSparseIterate(b *testing.B) {
-	b.StopTimer()
-	s := New(100000)
-	for i := 0; i < 100000; i += 30 {
-		s.Set(uint64(i))
+func TestMatchesRuns(t *testing.T) {
+	v := New(1000)
+	for i := uint64(3); i < 10; i++ {
+		v.Set(i)
 	}
-	b.StartTimer()
-	for j := 0; j < b.N; j++ {
-		c := uint(0)
-		for i, e := s.NextSet(0); e; i, e = s.NextSet(i + 1) {
-			c++
+	for i := uint64(60); i < 300; i++ {
+		v.Set(i)
+	}
+	v.Set(500)
+
+	runs := [][2]uint64{{3, 7}, {60, 240}, {500, 1}}
+	if !v.MatchesRuns(runs) {
+		t.Errorf("Set should match its runs; RunLengths is %v", v.RunLengths())
+	}
+	if rl := v.RunLengths(); len(rl) != 3 || rl[1] != runs[1] {
+		t.Errorf("RunLengths is wrong: %v", rl)
+	}
+
+	for _, p := range [][][2]uint64{
+		{{3, 7}, {60, 241}, {500, 1}},
+		{{3, 7}, {60, 240}},
+		{{3, 7}, {60, 240}, {500, 1}, {600, 1}},
+		{{4, 6}, {60, 240}, {500, 1}},
+	} {
+		if v.MatchesRuns(p) {
+			t.Errorf("Set should not match the perturbed runs %v", p)
+		}
+	}
+
+	if !New(0).MatchesRuns(nil) {
+		t.Errorf("An empty set should match no runs")
+	}
+}
+
+func TestInPlaceSymmetricDifferenceMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for k := 0; k < 100; k++ {
+		a := New(10000)
+		b := New(10000)
+		for i := 0; i < 200; i++ {
+			a.Set(uint64(r.Int63n(10000)))
+			b.Set(uint64(r.Int63n(10000)))
+		}
+		if k%2 == 0 { // plenty of spare capacity
+			a.set = append(make(blockAry, 0, 1000), a.set...)
+		}
+
+		exp := a.SymmetricDifference(b)
+		a.InPlaceSymmetricDifference(b)
+		if !a.Equal(exp) {
+			t.Fatalf("InPlaceSymmetricDifference should match SymmetricDifference")
+		}
+	}
+
+	a := New(1000).Set(1).Set(100)
+	a.InPlaceSymmetricDifference(a)
+	if !a.IsEmpty() {
+		t.Errorf("Symmetric difference with itself should be empty")
+	}
+}
+
+func TestWriteToReverse(t *testing.T) {
+	v := New(100000)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		v.Set(uint64(r.Int63n(100000)))
+	}
+
+	var buf bytes.Buffer
+	n, err := v.WriteToReverse(&buf)
+	if err != nil || n != int64(buf.Len()) || n != int64(1+v.bodySize()) {
+		t.Fatalf("WriteToReverse wrote %d bytes, with error %v", n, err)
+	}
+	data := buf.Bytes()
+	if off := binary.BigEndian.Uint64(data[5:]); off != v.set[len(v.set)-1].Offset {
+		t.Errorf("The highest block should be written first, but %d was", off)
+	}
+
+	u := New(0).Set(7)
+	m, err := u.ReadFromReverse(bytes.NewReader(data))
+	if err != nil || m != n {
+		t.Fatalf("ReadFromReverse read %d bytes, with error %v", m, err)
+	}
+	if !u.Equal(v) {
+		t.Errorf("Reversed format should round-trip to an equal set")
+	}
+
+	var legacy bytes.Buffer
+	v.WriteTo(&legacy)
+	if _, err = u.ReadFromReverse(&legacy); err != ErrUnknownFormat {
+		t.Errorf("ReadFromReverse should reject other formats, but answered %v", err)
+	}
+
+	buf.Reset()
+	New(0).WriteToReverse(&buf)
+	if _, err = u.ReadFromReverse(&buf); err != nil || !u.IsEmpty() {
+		t.Errorf("Empty set should round-trip")
+	}
+}
+
+func TestApproxCardinality(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	v := New(0)
+	for off := uint64(0); off < 100000; off++ {
+		v.set = append(v.set, block{off, r.Uint64() | 1})
+	}
+	exact := v.Cardinality()
+
+	est := v.ApproxCardinality(5000, rand.New(rand.NewSource(1)))
+	if math.Abs(float64(est)-float64(exact)) > 0.02*float64(exact) {
+		t.Errorf("Estimate %d is not within 2%% of %d", est, exact)
+	}
+	if est2 := v.ApproxCardinality(5000, rand.New(rand.NewSource(1))); est2 != est {
+		t.Errorf("The same source of randomness should give the same estimate")
+	}
+	if est = v.ApproxCardinality(len(v.set), r); est != exact {
+		t.Errorf("Sampling all the blocks should give %d, but gave %d", exact, est)
+	}
+	if est = v.ApproxCardinality(0, r); est != 0 {
+		t.Errorf("An empty sample should give 0, but gave %d", est)
+	}
+	if est = New(0).ApproxCardinality(10, nil); est != 0 {
+		t.Errorf("An empty set should give 0, but gave %d", est)
+	}
+}
+
+func TestCommonPrefixSuffixLen(t *testing.T) {
+	base := func() *BitSet {
+		v := New(1000)
+		for i := uint64(0); i < 10; i++ {
+			v.Set(i * 64)
 		}
+		return v
+	}
+
+	a := base()
+	b := base().Set(64*10 + 1).Set(64*11 + 1)
+	if n := a.CommonPrefixLen(b); n != 10 {
+		t.Errorf("Common prefix should be 10 blocks, but is %d", n)
+	}
+	if n := a.CommonSuffixLen(b); n != 0 {
+		t.Errorf("Common suffix should be 0 blocks, but is %d", n)
+	}
+
+	b = base().Set(1)
+	if n := a.CommonPrefixLen(b); n != 0 {
+		t.Errorf("Common prefix should be 0 blocks, but is %d", n)
+	}
+	if n := a.CommonSuffixLen(b); n != 9 {
+		t.Errorf("Common suffix should be 9 blocks, but is %d", n)
+	}
+
+	b = base().Set(64*5 + 1)
+	if p, s := a.CommonPrefixLen(b), a.CommonSuffixLen(b); p != 5 || s != 4 {
+		t.Errorf("Common prefix and suffix should be 5 and 4 blocks, but are %d and %d", p, s)
+	}
+
+	b = New(1000).Set(1).Set(64*20 + 1)
+	if p, s := a.CommonPrefixLen(b), a.CommonSuffixLen(b); p != 0 || s != 0 {
+		t.Errorf("Nothing should be common, but prefix and suffix are %d and %d", p, s)
+	}
+
+	if p, s := a.CommonPrefixLen(a), a.CommonSuffixLen(a); p != 10 || s != 10 {
+		t.Errorf("A set should share all its blocks with itself")
+	}
+	if a.CommonPrefixLen(nil) != 0 || a.CommonSuffixLen(nil) != 0 {
+		t.Errorf("Nothing should be common with nil")
+	}
+}
+
+func TestAgreement(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	a := New(1000)
+	b := New(1000)
+	for i := 0; i < 100; i++ {
+		a.Set(uint64(r.Int63n(1000)))
+		b.Set(uint64(r.Int63n(1000)))
+	}
+	a.Set(0).Set(5000)
+	b.Set(0).Set(64)
+
+	in := func(v *BitSet) map[uint64]bool {
+		m := make(map[uint64]bool)
+		for _, i := range setBits(v) {
+			m[i] = true
+		}
+		return m
+	}
+	ma, mb := in(a), in(b)
+
+	for _, u := range []uint64{0, 1, 63, 64, 65, 500, 1000, 1024, 1030, 6000} {
+		g := a.Agreement(b, u)
+		mg := in(g)
+		for i := uint64(0); i < u+70; i++ {
+			exp := i < u && ma[i] == mb[i]
+			if mg[i] != exp {
+				t.Fatalf("Agreement(%d) at %d should be %v", u, i, exp)
+			}
+		}
+		if n, _ := a.SymmetricDifferenceCardinality(b); u >= 5001 && g.Count() != u-n {
+			t.Errorf("Agreement(%d) should have %d bits, but has %d", u, u-n, g.Count())
+		}
+	}
+
+	if a.Agreement(nil, 10) != nil {
+		t.Errorf("Agreement with nil should be nil")
+	}
+}
+
+func TestWriteToChecked(t *testing.T) {
+	v := New(100000)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		v.Set(uint64(r.Int63n(100000)))
+	}
+
+	var buf bytes.Buffer
+	n, err := v.WriteToChecked(&buf)
+	if err != nil || n != int64(buf.Len()) || n != int64(1+v.bodySize()+4) {
+		t.Fatalf("WriteToChecked wrote %d bytes, with error %v", n, err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	u := New(0)
+	m, err := u.ReadFromChecked(&buf)
+	if err != nil || m != n {
+		t.Fatalf("ReadFromChecked read %d bytes, with error %v", m, err)
+	}
+	if !u.Equal(v) {
+		t.Errorf("Checked format should round-trip to an equal set")
+	}
+
+	for _, pos := range []int{0, 4, 5, 50, len(data) - 1} {
+		bad := append([]byte(nil), data...)
+		bad[pos] ^= 0x10
+		w := New(0).Set(1)
+		if _, err = w.ReadFromChecked(bytes.NewReader(bad)); err == nil {
+			t.Errorf("A flipped byte at %d should be detected", pos)
+		}
+		if !w.Equal(New(0).Set(1)) {
+			t.Errorf("A failed read should leave the set unchanged")
+		}
+	}
+	bad := append([]byte(nil), data...)
+	bad[50] ^= 0x01
+	if _, err = u.ReadFromChecked(bytes.NewReader(bad)); err != ErrChecksumMismatch {
+		t.Errorf("A flipped byte should give a checksum error, but gave %v", err)
+	}
+}
+
+func TestForEachIn(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	a := New(10000)
+	b := New(10000)
+	for i := 0; i < 1000; i++ {
+		a.Set(uint64(r.Int63n(10000)))
+		b.Set(uint64(r.Int63n(10000)))
+	}
+
+	exp := setBits(a.Intersection(b))
+	var got []uint64
+	a.ForEachIn(b, func(i uint64) bool {
+		got = append(got, i)
+		return true
+	})
+	if len(got) != len(exp) {
+		t.Fatalf("ForEachIn visited %d bits, but %d are common", len(got), len(exp))
+	}
+	for k := range exp {
+		if got[k] != exp[k] {
+			t.Fatalf("ForEachIn visited %d, but expected %d", got[k], exp[k])
+		}
+	}
+
+	got = got[:0]
+	a.ForEachIn(b, func(i uint64) bool {
+		got = append(got, i)
+		return len(got) < 5
+	})
+	if len(got) != 5 || got[4] != exp[4] {
+		t.Errorf("ForEachIn should stop when the callback answers false")
+	}
+
+	a.ForEachIn(nil, func(i uint64) bool {
+		t.Errorf("ForEachIn should not visit any bit for nil")
+		return true
+	})
+}
+
+func TestXorAssignTracked(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for k := 0; k < 20; k++ {
+		a := New(10000)
+		b := New(10000)
+		for i := 0; i < 500; i++ {
+			a.Set(uint64(r.Int63n(10000)))
+			b.Set(uint64(r.Int63n(10000)))
+		}
+		before := a.Count()
+		common, _ := a.IntersectionCardinality(b)
+		exp := a.SymmetricDifference(b)
+
+		on, off := a.XorAssignTracked(b)
+		if !a.Equal(exp) {
+			t.Fatalf("XorAssignTracked should match SymmetricDifference")
+		}
+		if off != common {
+			t.Errorf("%d bits should have been cleared, but %d were", common, off)
+		}
+		if before+on-off != a.Count() {
+			t.Errorf("Counts %d and %d do not explain the change from %d to %d", on, off, before, a.Count())
+		}
+		if on != b.Count()-common {
+			t.Errorf("%d bits should have been set, but %d were", b.Count()-common, on)
+		}
+	}
+
+	if on, off := New(0).Set(1).XorAssignTracked(nil); on != 0 || off != 0 {
+		t.Errorf("Nothing should flip for nil")
+	}
+}
+
+func TestCoverageSummary(t *testing.T) {
+	v := New(100000).Set(100).Set(200).Set(1099)
+	min, max, n, pct := v.CoverageSummary()
+	if min != 100 || max != 1099 || n != 3 || pct != 0.3 {
+		t.Errorf("Sparse summary is wrong: %d, %d, %d, %f", min, max, n, pct)
+	}
+
+	v = New(1000)
+	for i := uint64(64); i < 192; i++ {
+		v.Set(i)
+	}
+	min, max, n, pct = v.CoverageSummary()
+	if min != 64 || max != 191 || n != 128 || pct != 100 {
+		t.Errorf("Dense summary is wrong: %d, %d, %d, %f", min, max, n, pct)
+	}
+
+	min, max, n, pct = New(0).CoverageSummary()
+	if min != 0 || max != 0 || n != 0 || pct != 0 {
+		t.Errorf("Empty summary should be all zeroes")
+	}
+}
+
+func TestToMap(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	v := New(100000).Set(0)
+	for i := 0; i < 1000; i++ {
+		v.Set(uint64(r.Int63n(100000)))
+	}
+
+	m := v.ToMap()
+	if uint64(len(m)) != v.Count() {
+		t.Errorf("Map should have %d keys, but has %d", v.Count(), len(m))
+	}
+	for _, i := range setBits(v) {
+		if _, ok := m[i]; !ok {
+			t.Errorf("Map should have the key %d", i)
+		}
+	}
+	if !FromMap(m).Equal(v) {
+		t.Errorf("FromMap(ToMap()) should round-trip to an equal set")
+	}
+
+	if len(New(0).ToMap()) != 0 || !FromMap(nil).IsEmpty() {
+		t.Errorf("Empty sets and maps should map to each other")
+	}
+}
+
+func TestInPlaceUnionRange(t *testing.T) {
+	a := New(1000).Set(1).Set(100).Set(900)
+	c := New(1000)
+	for i := uint64(0); i < 1000; i += 3 {
+		c.Set(i)
+	}
+
+	for _, r := range [][2]uint64{{0, 1000}, {10, 20}, {63, 65}, {64, 128}, {70, 700}, {5, 5}, {2000, 3000}} {
+		b := a.Clone()
+		b.InPlaceUnionRange(c, r[0], r[1])
+		for i := uint64(0); i < 1000; i++ {
+			exp := a.Test(i) || (i >= r[0] && i < r[1] && c.Test(i))
+			if b.Test(i) != exp {
+				t.Fatalf("InPlaceUnionRange(%d, %d) at %d should be %v", r[0], r[1], i, exp)
+			}
+		}
+		for k := 1; k < len(b.set); k++ {
+			if b.set[k-1].Offset >= b.set[k].Offset {
+				t.Fatalf("Blocks should be in ascending order of offsets")
+			}
+		}
+	}
+
+	if a.InPlaceUnionRange(c, 10, 5) != nil || a.InPlaceUnionRange(nil, 5, 10) != nil {
+		t.Errorf("InPlaceUnionRange should reject nil and reversed ranges")
+	}
+}
+
+func TestDifferenceRange(t *testing.T) {
+	a := New(1000)
+	for i := uint64(1); i < 1000; i += 2 {
+		a.Set(i)
+	}
+	a.Set(5000)
+
+	for _, r := range [][2]uint64{{0, 1000}, {10, 20}, {63, 65}, {64, 128}, {70, 700}, {5, 5}, {999, 6000}, {2000, 3000}} {
+		rng := New(0)
+		for i := r[0]; i < r[1]; i++ {
+			rng.Set(i)
+		}
+		exp := a.Difference(rng)
+
+		b := a.DifferenceRange(r[0], r[1])
+		if !b.Equal(exp) {
+			t.Errorf("DifferenceRange(%d, %d) should match Difference", r[0], r[1])
+		}
+		c := a.Clone().InPlaceDifferenceRange(r[0], r[1])
+		if !c.Equal(exp) {
+			t.Errorf("InPlaceDifferenceRange(%d, %d) should match Difference", r[0], r[1])
+		}
+		for i := uint64(0); i < 6000; i++ {
+			if i >= r[0] && i < r[1] && c.Test(i) {
+				t.Fatalf("Bit %d in the range should have been removed", i)
+			}
+			if (i < r[0] || i >= r[1]) && c.Test(i) != a.Test(i) {
+				t.Fatalf("Bit %d outside the range should have been preserved", i)
+			}
+		}
+	}
+
+	if a.DifferenceRange(10, 5) != nil || a.InPlaceDifferenceRange(10, 5) != nil {
+		t.Errorf("Reversed ranges should be rejected")
+	}
+}
+
+func TestReadAuto(t *testing.T) {
+	v := New(100000)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		v.Set(uint64(r.Int63n(100000)))
+	}
+
+	var standard, legacy, reversed, checked, compressed, streamed bytes.Buffer
+	v.WriteTo(&standard)
+	v.writeBody(&legacy)
+	v.WriteToReverse(&reversed)
+	v.WriteToChecked(&checked)
+	v.WriteToCompressed(&compressed)
+	v.WriteBlocksTo(&streamed)
+
+	for _, c := range []struct {
+		buf *bytes.Buffer
+		f   Format
+	}{
+		{&standard, FormatStandard},
+		{&legacy, FormatLegacy},
+		{&reversed, FormatReversed},
+		{&checked, FormatChecked},
+		{&compressed, FormatCompressed},
+		{&streamed, FormatStreamed},
+	} {
+		f, err := DetectFormat(bufio.NewReader(bytes.NewReader(c.buf.Bytes())))
+		if err != nil || f != c.f {
+			t.Errorf("DetectFormat should answer %#x, but answered %#x, %v", c.f, f, err)
+		}
+		f, _ = DetectFormat(bytes.NewReader(c.buf.Bytes()))
+		if f != c.f {
+			t.Errorf("DetectFormat should answer %#x, but answered %#x", c.f, f)
+		}
+
+		u, err := ReadAuto(c.buf)
+		if err != nil || !u.Equal(v) {
+			t.Errorf("ReadAuto should decode format %#x, but answered %v", c.f, err)
+		}
+	}
+
+	bad := []byte{0xfe, 0, 0, 0, 0}
+	if _, err := DetectFormat(bytes.NewReader(bad)); err != ErrUnknownFormat {
+		t.Errorf("DetectFormat should reject unknown versions, but answered %v", err)
+	}
+	if _, err := ReadAuto(bytes.NewReader(bad)); err != ErrUnknownFormat {
+		t.Errorf("ReadAuto should reject unknown versions, but answered %v", err)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for n := 0; n < 20; n++ {
+		v := New(10000)
+		added := New(10000)
+		removed := New(10000)
+		for i := 0; i < 500; i++ {
+			v.Set(uint64(r.Int63n(10000)))
+			added.Set(uint64(r.Int63n(10000)))
+			removed.Set(uint64(r.Int63n(10000)))
+		}
+
+		exp := v.Union(added).Difference(removed)
+		v.ApplyDelta(added, removed)
+		if !v.Equal(exp) {
+			t.Fatalf("ApplyDelta should match Union followed by Difference")
+		}
+	}
+
+	v := New(100).Set(1).Set(2)
+	v.ApplyDelta(New(100).Set(3).Set(4), New(100).Set(2).Set(4))
+	if !v.Equal(New(100).Set(1).Set(3)) {
+		t.Errorf("A bit both added and removed should be removed")
+	}
+	v.ApplyDelta(nil, nil)
+	if !v.Equal(New(100).Set(1).Set(3)) {
+		t.Errorf("A nil delta should change nothing")
+	}
+}
+
+func TestWordEntropy(t *testing.T) {
+	v := New(100000)
+	for off := uint64(0); off < 100; off++ {
+		v.Set(off*wordSize + 3).Set(off*wordSize + 9)
+	}
+	if h := v.PopcountHistogram(); h[2] != 100 {
+		t.Errorf("All 100 blocks should have 2 bits set, but %d do", h[2])
+	}
+	if e := v.WordEntropy(); e != 0 {
+		t.Errorf("Uniformly filled blocks should have zero entropy, but have %f", e)
+	}
+
+	// Blocks with 1, 1, 2 and 4 bits set: -(1/2 log 1/2 + 2 * 1/4 log 1/4).
+	v = New(1000).Set(1).Set(65).Set(129).Set(130)
+	v.Set(193).Set(194).Set(195).Set(196)
+	if e := v.WordEntropy(); e != 1.5 {
+		t.Errorf("Entropy should be 1.5, but is %f", e)
+	}
+
+	if e := New(0).WordEntropy(); e != 0 {
+		t.Errorf("An empty set should have zero entropy, but has %f", e)
+	}
+}
+
+func TestJaccardMatrix(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	sets := make([]*BitSet, 6)
+	for k := range sets {
+		sets[k] = New(1000)
+		for i := 0; i < 200; i++ {
+			sets[k].Set(uint64(r.Int63n(1000)))
+		}
+	}
+	sets[4] = New(0)
+	sets[5] = New(0)
+
+	for _, m := range [][][]float64{JaccardMatrix(sets), JaccardMatrixParallel(sets, 4)} {
+		if len(m) != len(sets) {
+			t.Fatalf("Matrix should have %d rows, but has %d", len(sets), len(m))
+		}
+		for i := range sets {
+			if m[i][i] != 1 {
+				t.Errorf("Diagonal should be 1, but [%d][%d] is %f", i, i, m[i][i])
+			}
+			for j := range sets {
+				exp, _ := sets[i].Jaccard(sets[j])
+				if m[i][j] != exp {
+					t.Errorf("[%d][%d] should be %f, but is %f", i, j, exp, m[i][j])
+				}
+				if m[i][j] != m[j][i] {
+					t.Errorf("Matrix should be symmetric at [%d][%d]", i, j)
+				}
+			}
+		}
+	}
+
+	if m := JaccardMatrix([]*BitSet{nil, New(0).Set(1)}); m[0][1] != 0 || m[0][0] != 1 {
+		t.Errorf("A nil set should be treated as empty")
+	}
+}
+
+func TestClearCongruent(t *testing.T) {
+	v := New(1000)
+	for i := uint64(0); i < 1000; i++ {
+		v.Set(i)
+	}
+	v.ClearCongruent(2, 0)
+	if v.Count() != 500 {
+		t.Errorf("Only the 500 odd indices should remain, but %d do", v.Count())
+	}
+	for _, i := range setBits(v) {
+		if i%2 != 1 {
+			t.Errorf("Even index %d should have been cleared", i)
+		}
+	}
+
+	for _, c := range [][2]uint64{{3, 1}, {7, 6}, {64, 5}, {100, 99}, {1 << 63, 5}} {
+		u := New(0)
+		for i := uint64(0); i < 2000; i += 1 + i%3 {
+			u.Set(i)
+		}
+		exp := New(0)
+		for _, i := range setBits(u) {
+			if i%c[0] != c[1] {
+				exp.Set(i)
+			}
+		}
+		if !u.ClearCongruent(c[0], c[1]).Equal(exp) {
+			t.Errorf("ClearCongruent(%d, %d) should clear exactly the congruent bits", c[0], c[1])
+		}
+	}
+
+	if v.ClearCongruent(0, 0) != nil {
+		t.Errorf("ClearCongruent should reject a zero modulus")
+	}
+	if v.ClearCongruent(3, 3); v.Count() != 500 {
+		t.Errorf("A residue not less than the modulus should clear nothing")
+	}
+}
+
+func TestMarginalGain(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	cands := make([]*BitSet, 10)
+	for k := range cands {
+		cands[k] = New(2000)
+		for i := 0; i < 300; i++ {
+			cands[k].Set(uint64(r.Int63n(2000)))
+		}
+	}
+
+	acc := New(2000)
+	for len(cands) > 0 {
+		best, gain := 0, uint64(0)
+		for k, c := range cands {
+			if g := acc.MarginalGain(c); g > gain {
+				best, gain = k, g
+			}
+		}
+
+		before := acc.Count()
+		exp, _ := cands[best].DifferenceCardinality(acc)
+		if gain != exp {
+			t.Errorf("Gain should be %d, but is %d", exp, gain)
+		}
+		acc.InPlaceUnion(cands[best])
+		if acc.Count() != before+gain {
+			t.Errorf("Accumulator should grow by %d, but grew by %d", gain, acc.Count()-before)
+		}
+		cands = append(cands[:best], cands[best+1:]...)
+	}
+
+	if acc.MarginalGain(acc) != 0 || acc.MarginalGain(nil) != 0 {
+		t.Errorf("Nothing should be gained from itself or nil")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	v := New(1000).Set(1).Set(100).Set(1000)
+	exp := v.Clone()
+
+	restore := v.Checkpoint()
+	v.Set(2).Clear(100).Set(5000)
+	v.InPlaceUnion(New(0).Set(64))
+	if v.Equal(exp) {
+		t.Fatalf("Set should have changed after the checkpoint")
+	}
+	restore()
+	if !v.Equal(exp) {
+		t.Errorf("Set should be restored to its checkpointed contents")
+	}
+
+	v.ClearAll()
+	restore()
+	if !v.Equal(exp) {
+		t.Errorf("Set should be restored again to its checkpointed contents")
+	}
+}
+
+func TestMissingInRange(t *testing.T) {
+	v := New(1000)
+	for i := uint64(10); i < 500; i++ {
+		if i != 63 && i != 64 && i != 300 {
+			v.Set(i)
+		}
+	}
+
+	m := v.MissingInRange(10, 500)
+	if len(m) != 3 || m[0] != 63 || m[1] != 64 || m[2] != 300 {
+		t.Errorf("Missing indices should be [63 64 300], but are %v", m)
+	}
+	m = v.MissingInRange(5, 12)
+	if len(m) != 5 || m[0] != 5 || m[4] != 9 {
+		t.Errorf("Missing indices should be [5 6 7 8 9], but are %v", m)
+	}
+	m = v.MissingInRange(498, 503)
+	if len(m) != 3 || m[0] != 500 || m[2] != 502 {
+		t.Errorf("Missing indices should be [500 501 502], but are %v", m)
+	}
+	m = v.MissingInRange(65, 300)
+	if m == nil || len(m) != 0 {
+		t.Errorf("A fully-set range should answer an empty slice, but answered %v", m)
+	}
+	if m = v.MissingInRange(2000, 2000+64*5); len(m) != 64*5 {
+		t.Errorf("All bits in a gap should be missing, but %d are", len(m))
+	}
+	if m = v.MissingInRange(20, 10); len(m) != 0 {
+		t.Errorf("An empty range should answer an empty slice")
+	}
+}
+
+func TestFind(t *testing.T) {
+	var a blockAry
+	for off := uint64(10); off < 1000; off += 10 {
+		a = append(a, block{off, 1})
+	}
+
+	for off := uint64(0); off < 1100; off++ {
+		i, found := a.find(off)
+		if found != (off%10 == 0 && off >= 10 && off < 1000) {
+			t.Fatalf("find(%d) should not answer %v", off, found)
+		}
+		if (i < len(a) && a[i].Offset < off) || (i > 0 && a[i-1].Offset >= off) {
+			t.Fatalf("find(%d) answered the wrong position %d", off, i)
+		}
+	}
+
+	if i, found := blockAry(nil).find(5); i != 0 || found {
+		t.Errorf("find in an empty slice should answer (0, false)")
+	}
+}
+
+// popcountHamming is the hand-rolled bit population count (Hamming
+// Weight) that `popcount` replaced, taken from
+// https://code.google.com/p/go/issues/detail?id=4988#c11.  Original
+// by 'https://code.google.com/u/arnehormann/'.
+func popcountHamming(x uint64) (n uint64) {
+	x -= (x >> 1) & 0x5555555555555555
+	x = (x>>2)&0x3333333333333333 + x&0x3333333333333333
+	x += x >> 4
+	x &= 0x0f0f0f0f0f0f0f0f
+	x *= 0x0101010101010101
+	return x >> 56
+}
+
+func FuzzPopcount(f *testing.F) {
+	for _, x := range []uint64{0, 1, allOnes, 0x8000000000000000, 0x5555555555555555} {
+		f.Add(x)
+	}
+	f.Fuzz(func(t *testing.T, x uint64) {
+		if popcount(x) != popcountHamming(x) {
+			t.Errorf("popcount(%#x) is %d, but should be %d", x, popcount(x), popcountHamming(x))
+		}
+	})
+}
+
+func TestPopcount(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		x := r.Uint64() >> uint(r.Intn(64))
+		if popcount(x) != popcountHamming(x) {
+			t.Fatalf("popcount(%#x) is %d, but should be %d", x, popcount(x), popcountHamming(x))
+		}
+	}
+}
+
+func TestTrailingZeroes64(t *testing.T) {
+	for i := uint64(0); i < wordSize; i++ {
+		if n := trailingZeroes64(1 << i); n != i {
+			t.Errorf("trailingZeroes64(1<<%d) should be %d, but is %d", i, i, n)
+		}
+		if n := trailingZeroes64(allOnes << i); n != i {
+			t.Errorf("trailingZeroes64(allOnes<<%d) should be %d, but is %d", i, i, n)
+		}
+	}
+	if n := trailingZeroes64(0); n != 0 {
+		t.Errorf("trailingZeroes64(0) should be 0, but is %d", n)
+	}
+}
+
+func TestBitZero(t *testing.T) {
+	v := New(100).Set(0)
+	if v.Test(0) != true {
+		t.Errorf("Bit 0 should be set")
+	}
+	if v.Cardinality() != 1 {
+		t.Errorf("Cardinality should be 1, but is %d", v.Cardinality())
+	}
+	if i, ok := v.NextSet(0); !ok || i != 0 {
+		t.Errorf("NextSet(0) should answer (0, true), but answered (%d, %v)", i, ok)
+	}
+	if b := setBits(v); len(b) != 1 || b[0] != 0 {
+		t.Errorf("Iteration should yield only 0, but yielded %v", b)
+	}
+
+	v.Clear(0)
+	if v.Test(0) != false || !v.IsEmpty() {
+		t.Errorf("Bit 0 should be clear, and the set empty")
+	}
+
+	c := New(100).Set(3).Complement()
+	if !c.Equal(New(100).Set(0).Set(1).Set(2)) {
+		t.Errorf("Complement should include bit 0, but is %v", setBits(c))
+	}
+}
+
+func TestInsertKeepsPrefix(t *testing.T) {
+	v := New(0).Set(0).Set(128).Set(64)
+	for _, i := range []uint64{0, 64, 128} {
+		if v.Test(i) != true {
+			t.Errorf("Bit %d is clear, and it shouldn't be.", i)
+		}
+	}
+	if len(v.set) != 3 || v.set[0].Offset != 0 || v.set[1].Offset != 1 || v.set[2].Offset != 2 {
+		t.Errorf("Blocks should be at offsets 0, 1 and 2, but are %v", v.set)
+	}
+	if v.Count() != 3 {
+		t.Errorf("Count should be 3, but is %d", v.Count())
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	v := New(100000).Set(0)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		v.Set(uint64(r.Int63n(100000)))
+	}
+
+	var buf bytes.Buffer
+	n, err := v.WriteTo(&buf)
+	if err != nil || n != int64(v.BinaryStorageSize()) || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo wrote %d bytes, with error %v", n, err)
+	}
+
+	u := New(0).Set(7)
+	m, err := u.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if m != int64(v.BinaryStorageSize()) {
+		t.Errorf("ReadFrom should read %d bytes, but read %d", v.BinaryStorageSize(), m)
+	}
+	if !u.Equal(v) {
+		t.Errorf("Round trip should answer an equal set")
+	}
+}
+
+func TestCopyReplaces(t *testing.T) {
+	b := New(0).Set(3).Set(200).Set(5000)
+	c := New(0).Set(1).Set(100).Set(70000).Set(90000)
+	if n := b.Copy(c); n != 3*16 {
+		t.Errorf("Copy should answer %d, but answered %d", 3*16, n)
+	}
+	if !c.Equal(b) {
+		t.Errorf("Copy into a non-empty destination should replace its contents")
+	}
+
+	c.Set(7)
+	if b.Test(7) {
+		t.Errorf("Copy should not share storage with the source")
+	}
+
+	e := New(0).Set(1)
+	New(0).Copy(e)
+	if !e.None() {
+		t.Errorf("Copying an empty bitset should clear the destination")
+	}
+}
+
+func TestMutatorErrors(t *testing.T) {
+	v := New(0)
+	if c, err := v.SetE(10); err != nil || c != v || !v.Test(10) {
+		t.Errorf("SetE should set the bit and answer the bitset, got %v", err)
+	}
+	if c, err := v.ClearE(10); err != nil || c != v || v.Test(10) {
+		t.Errorf("ClearE should clear the bit and answer the bitset, got %v", err)
+	}
+
+	if c, err := v.FlipE(1000); err != nil || c != v || !v.Test(1000) {
+		t.Errorf("FlipE on an absent block should set the bit, got %v", err)
+	}
+	if c, err := v.FlipE(1000); err != nil || c != v || !v.None() || len(v.set) != 0 {
+		t.Errorf("FlipE to zero should remove the emptied block, got %v", err)
+	}
+}
+
+func TestBits(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	v := New(0)
+	for i := 0; i < 1000; i++ {
+		v.Set(uint64(r.Int63n(1 << 20)))
+	}
+	v.Set(0).Set(63).Set(64)
+
+	exp := setBits(v)
+	var got []uint64
+	for idx := range v.Bits() {
+		got = append(got, idx)
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("Bits yielded %d indices, expected %d", len(got), len(exp))
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("Bits yielded %d at position %d, expected %d", got[i], i, exp[i])
+		}
+	}
+
+	// Breaking out early must stop the sequence.
+	n := 0
+	for range v.Bits() {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("Bits should stop when the loop breaks")
+	}
+
+	for range New(0).Bits() {
+		t.Errorf("Bits of an empty bitset should yield nothing")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for k := 0; k < 20; k++ {
+		v := New(0)
+		n := r.Intn(500)
+		for i := 0; i < n; i++ {
+			v.Set(uint64(r.Int63n(1 << uint(8+k))))
+		}
+
+		exp := setBits(v)
+		var got []uint64
+		it := v.Iterator()
+		for idx, ok := it.Next(); ok; idx, ok = it.Next() {
+			got = append(got, idx)
+		}
+		if len(got) != len(exp) {
+			t.Fatalf("Iterator yielded %d indices, expected %d", len(got), len(exp))
+		}
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Fatalf("Iterator yielded %d at position %d, expected %d", got[i], i, exp[i])
+			}
+		}
+		if _, ok := it.Next(); ok {
+			t.Errorf("An exhausted iterator should stay exhausted")
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for k := 0; k < 10; k++ {
+		v := New(0)
+		for i := 0; i < 300; i++ {
+			v.Set(uint64(r.Int63n(1 << 14)))
+		}
+		bits := setBits(v)
+		last := bits[len(bits)-1]
+
+		rank := func(n uint64) uint64 {
+			c := uint64(0)
+			for _, i := range bits {
+				if i < n {
+					c++
+				}
+			}
+			return c
+		}
+		probes := []uint64{0, last, last + 1, last + 1000, math.MaxUint64}
+		for i := 0; i < 200; i++ {
+			probes = append(probes, uint64(r.Int63n(1<<14)))
+		}
+		for _, n := range probes {
+			if got, exp := v.Rank(n), rank(n); got != exp {
+				t.Errorf("Rank(%d) should be %d, but is %d", n, exp, got)
+			}
+		}
+		if v.Rank(last+1) != v.Cardinality() {
+			t.Errorf("Rank just past the highest set bit should equal the cardinality")
+		}
+	}
+
+	if New(0).Rank(100) != 0 {
+		t.Errorf("Rank of an empty bitset should be 0")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	v := New(0)
+	for i := 0; i < 2000; i++ {
+		v.Set(uint64(r.Int63n(1 << 16)))
+	}
+	v.Set(0).Set(1 << 40)
+
+	for _, i := range setBits(v) {
+		if j, ok := v.Select(v.Rank(i)); !ok || j != i {
+			t.Errorf("Select(Rank(%d)) should be %d, but is %d (%v)", i, i, j, ok)
+		}
+	}
+
+	c := v.Cardinality()
+	if _, ok := v.Select(c); ok {
+		t.Errorf("Select(%d) should fail for a cardinality of %d", c, c)
+	}
+	if _, ok := New(0).Select(0); ok {
+		t.Errorf("Select on an empty bitset should fail")
+	}
+}
+
+func TestToSlice(t *testing.T) {
+	if s := New(0).ToSlice(); s == nil || len(s) != 0 {
+		t.Errorf("ToSlice of an empty bitset should be an empty, non-nil slice")
+	}
+
+	if s := New(0).Set(77).ToSlice(); len(s) != 1 || s[0] != 77 {
+		t.Errorf("ToSlice should be [77], but is %v", s)
+	}
+
+	exp := []uint64{0, 1, 63, 64, 200, 4095, 4096, 1 << 40}
+	v := New(0)
+	for i := len(exp) - 1; i >= 0; i-- {
+		v.Set(exp[i])
+	}
+	s := v.ToSlice()
+	if len(s) != len(exp) || uint64(len(s)) != v.Cardinality() {
+		t.Fatalf("ToSlice should answer %d indices, but answered %d", len(exp), len(s))
+	}
+	for i := range exp {
+		if s[i] != exp[i] {
+			t.Errorf("ToSlice[%d] should be %d, but is %d", i, exp[i], s[i])
+		}
+	}
+}
+
+func TestNewFromSlice(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	idx := make([]uint64, 5000)
+	exp := New(0)
+	for i := range idx {
+		idx[i] = uint64(r.Int63n(1 << 18))
+		exp.Set(idx[i])
+	}
+	idx = append(idx, idx[:100]...) // duplicates
+	orig := append([]uint64(nil), idx...)
+
+	v := NewFromSlice(idx)
+	if !v.Equal(exp) {
+		t.Errorf("NewFromSlice should equal the bits set one at a time")
+	}
+	for i := range idx {
+		if idx[i] != orig[i] {
+			t.Fatalf("NewFromSlice should not modify its input")
+		}
+	}
+
+	sorted := v.ToSlice()
+	sorted = append(sorted, sorted[len(sorted)-1])
+	if !NewFromSortedSlice(sorted).Equal(exp) {
+		t.Errorf("NewFromSortedSlice should equal the bits set one at a time")
+	}
+	if NewFromSortedSlice([]uint64{1, 5, 200, 3}) != nil {
+		t.Errorf("NewFromSortedSlice should reject unsorted indices")
+	}
+
+	if !NewFromSlice(nil).None() {
+		t.Errorf("NewFromSlice of no indices should be empty")
+	}
+}
+
+func TestSetClearFlipRange(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	ranges := [][2]uint64{{0, 0}, {5, 5}, {0, 1}, {3, 60}, {0, 64}, {63, 65},
+		{100, 1000}, {64, 128}, {10, 10000}, {4000, 4200}}
+	for _, rg := range ranges {
+		base := New(0)
+		for i := 0; i < 100; i++ {
+			base.Set(uint64(r.Int63n(5000)))
+		}
+
+		set, clear, flip := base.Clone(), base.Clone(), base.Clone()
+		for i := rg[0]; i < rg[1]; i++ {
+			set.Set(i)
+			clear.Clear(i)
+			if flip.Test(i) {
+				flip.Clear(i)
+			} else {
+				flip.Set(i)
+			}
+		}
+
+		if !base.Clone().SetRange(rg[0], rg[1]).Equal(set) {
+			t.Errorf("SetRange(%d, %d) mismatch", rg[0], rg[1])
+		}
+		if !base.Clone().ClearRange(rg[0], rg[1]).Equal(clear) {
+			t.Errorf("ClearRange(%d, %d) mismatch", rg[0], rg[1])
+		}
+		v := base.Clone().FlipRange(rg[0], rg[1])
+		if !v.Equal(flip) {
+			t.Errorf("FlipRange(%d, %d) mismatch", rg[0], rg[1])
+		}
+		for _, el := range v.set {
+			if el.Bits == 0 {
+				t.Errorf("FlipRange(%d, %d) left an empty block", rg[0], rg[1])
+			}
+		}
+	}
+
+	// A range spanning many missing words.
+	v := New(0).Set(1<<30).SetRange(0, 64*1000)
+	if v.Cardinality() != 64*1000+1 || len(v.set) != 1001 {
+		t.Errorf("SetRange over empty words should fill them, got %d bits in %d blocks",
+			v.Cardinality(), len(v.set))
+	}
+
+	if New(0).SetRange(2, 1) != nil || New(0).ClearRange(2, 1) != nil ||
+		New(0).FlipRange(2, 1) != nil {
+		t.Errorf("A range with lo > hi should answer nil")
+	}
+}
+
+func TestFlipRangeTwice(t *testing.T) {
+	r := rand.New(rand.NewSource(17))
+	base := New(0).SetRange(60, 70).Set(1 << 40).Set(math.MaxUint64 - 3)
+	for i := 0; i < 200; i++ {
+		base.Set(uint64(r.Int63n(5000)))
+	}
+
+	for _, rg := range [][2]uint64{{0, 1}, {63, 65}, {64, 128}, {1, 4999},
+		{0, 1 << 20}, {1<<40 - 1, 1<<40 + 1}, {math.MaxUint64 - 70, math.MaxUint64}} {
+		v := base.Clone().FlipRange(rg[0], rg[1])
+		if v.Equal(base) {
+			t.Errorf("FlipRange(%d, %d) should change the set", rg[0], rg[1])
+		}
+		if !v.FlipRange(rg[0], rg[1]).Equal(base) || v.Cardinality() != base.Cardinality() {
+			t.Errorf("FlipRange(%d, %d) twice should answer the original set", rg[0], rg[1])
+		}
+	}
+
+	// Flipping an all-clear region creates its blocks.
+	v := New(0).FlipRange(60, 200)
+	want := blockAry{{0, 0xf << 60}, {1, allOnes}, {2, allOnes}, {3, 0xff}}
+	if !slices.Equal(v.set, want) || v.Cardinality() != 140 {
+		t.Errorf("Expected blocks %v, got %v", want, v.set)
+	}
+
+	// Flipping every bit of a block removes it.
+	v.FlipRange(64, 192)
+	want = blockAry{{0, 0xf << 60}, {3, 0xff}}
+	if !slices.Equal(v.set, want) || v.Cardinality() != 12 {
+		t.Errorf("Expected blocks %v, got %v", want, v.set)
+	}
+}
+
+func TestString(t *testing.T) {
+	if s := New(0).String(); s != "{}" {
+		t.Errorf("String of an empty bitset should be {}, but is %s", s)
+	}
+	if s := New(0).Set(2000).Set(0).Set(10).Set(1).Set(2).String(); s != "{0,1,2,10,2000}" {
+		t.Errorf("String should be {0,1,2,10,2000}, but is %s", s)
+	}
+
+	defer func(n int) { StringLimit = n }(StringLimit)
+	StringLimit = 3
+	if s := New(0).SetRange(0, 1000000).String(); s != "{0,1,2,...}" {
+		t.Errorf("String should be capped as {0,1,2,...}, but is %s", s)
+	}
+	if s := New(0).SetRange(5, 8).String(); s != "{5,6,7}" {
+		t.Errorf("String at exactly the limit should not be capped, but is %s", s)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, v := range []*BitSet{New(0), New(0).Set(5), New(0).Set(1).Set(1000).SetRange(5000, 9000)} {
+		data, err := v.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		u := New(0).Set(3)
+		if err = u.UnmarshalBinary(data); err != nil || !u.Equal(v) {
+			t.Errorf("Round trip through MarshalBinary failed: %v", err)
+		}
+	}
+
+	v := New(0).Set(1).Set(1000).Set(70000)
+	data, _ := v.MarshalBinary()
+	for i := 0; i < len(data); i++ {
+		if err := New(0).UnmarshalBinary(data[:i]); err == nil {
+			t.Errorf("UnmarshalBinary should reject data truncated to %d bytes", i)
+		}
+	}
+	if err := New(0).UnmarshalBinary(append(data, 0)); err != ErrInvalidLength {
+		t.Errorf("UnmarshalBinary should reject trailing data, got %v", err)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[1] = 0xff // huge length prefix
+	if err := New(0).UnmarshalBinary(bad); err != ErrInvalidLength {
+		t.Errorf("UnmarshalBinary should reject a bad length prefix, got %v", err)
+	}
+	bad = append([]byte(nil), data...)
+	bad[10] ^= 0x01
+	u := New(0).Set(3)
+	if err := u.UnmarshalBinary(bad); err != ErrChecksumMismatch || !u.Equal(New(0).Set(3)) {
+		t.Errorf("UnmarshalBinary should reject corrupt data, got %v", err)
+	}
+	bad[0] = 0x00
+	if err := New(0).UnmarshalBinary(bad); err != ErrUnknownFormat {
+		t.Errorf("UnmarshalBinary should reject an unknown format, got %v", err)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	for _, v := range []*BitSet{New(0), New(0).Set(1).Set(1000).SetRange(5000, 9000)} {
+		text, err := v.MarshalText()
+		if err != nil {
+			t.Fatalf("MarshalText failed: %v", err)
+		}
+		u := New(0).Set(3)
+		if err = u.UnmarshalText(text); err != nil || !u.Equal(v) {
+			t.Errorf("Round trip through MarshalText failed: %v", err)
+		}
+	}
+
+	defer func(e *base64.Encoding) { TextEncoding = e }(TextEncoding)
+	TextEncoding = base64.RawStdEncoding
+	v := New(0).Set(1).Set(1000)
+	text, _ := v.MarshalText()
+	if bytes.IndexByte(text, '=') >= 0 {
+		t.Errorf("MarshalText should not pad with RawStdEncoding: %s", text)
+	}
+	u := New(0)
+	if err := u.UnmarshalText(text); err != nil || !u.Equal(v) {
+		t.Errorf("Round trip through unpadded MarshalText failed: %v", err)
+	}
+
+	if err := u.UnmarshalText([]byte("not base64!")); err == nil {
+		t.Errorf("UnmarshalText should reject malformed base64")
+	}
+	if err := u.UnmarshalText(text[:len(text)-8]); err == nil {
+		t.Errorf("UnmarshalText should reject a truncated payload")
+	}
+	if !u.Equal(v) {
+		t.Errorf("UnmarshalText should leave the bitset unchanged on error")
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	v := New(0).Set(10).Set(0).Set(2).Set(1).Set(70000)
+	data, err := json.Marshal(v)
+	if err != nil || string(data) != "[0,1,2,10,70000]" {
+		t.Errorf("MarshalJSON should be [0,1,2,10,70000], but is %s (%v)", data, err)
+	}
+	if data, _ = json.Marshal(New(0)); string(data) != "[]" {
+		t.Errorf("MarshalJSON of an empty bitset should be [], but is %s", data)
+	}
+
+	u := New(0).Set(3)
+	if err = json.Unmarshal([]byte("[]"), u); err != nil || !u.None() {
+		t.Errorf("UnmarshalJSON of [] should answer an empty bitset: %v", err)
+	}
+	if err = json.Unmarshal([]byte("[70000, 10, 1, 2, 0, 10, 1]"), u); err != nil || !u.Equal(v) {
+		t.Errorf("UnmarshalJSON should accept unsorted input with duplicates: %v", err)
+	}
+	for _, bad := range []string{"[-1]", "[1.5]", "[1e3]", `["1"]`, "[null]", "{}", "[18446744073709551616]"} {
+		if err = json.Unmarshal([]byte(bad), u); err == nil {
+			t.Errorf("UnmarshalJSON should reject %s", bad)
+		}
+	}
+	if !u.Equal(v) {
+		t.Errorf("UnmarshalJSON should leave the bitset unchanged on error")
+	}
+	if err = u.UnmarshalJSON([]byte("null")); err != nil || !u.Equal(v) {
+		t.Errorf("UnmarshalJSON of null should be a no-op: %v", err)
+	}
+	var f struct{ Set BitSet }
+	f.Set.Set(5)
+	if err = json.Unmarshal([]byte(`{"Set": null}`), &f); err != nil || !f.Set.Equal(New(0).Set(5)) {
+		t.Errorf("UnmarshalJSON of a null field should be a no-op: %v", err)
+	}
+
+	var s struct {
+		Full    *BitSet
+		Compact *CompactBitSet
+	}
+	s.Full, s.Compact = v, (*CompactBitSet)(v)
+	data, err = json.Marshal(&s)
+	if err != nil || !bytes.Contains(data, []byte(`"Compact":"`)) {
+		t.Fatalf("CompactBitSet should marshal as a string: %s (%v)", data, err)
+	}
+	s.Full, s.Compact = nil, nil
+	if err = json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("Unmarshalling both forms failed: %v", err)
+	}
+	if !s.Full.Equal(v) || !(*BitSet)(s.Compact).Equal(v) {
+		t.Errorf("Round trip through both JSON forms should answer equal bitsets")
+	}
+}
+
+func TestGob(t *testing.T) {
+	type holder struct {
+		Name string
+		Set  *BitSet
+		Nil  *BitSet
+	}
+
+	v := New(0).Set(1).Set(1000).SetRange(5000, 9000)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(holder{"x", v, nil}); err != nil {
+		t.Fatalf("gob encoding failed: %v", err)
+	}
+
+	var h holder
+	if err := gob.NewDecoder(&buf).Decode(&h); err != nil {
+		t.Fatalf("gob decoding failed: %v", err)
+	}
+	if h.Name != "x" || !h.Set.Equal(v) {
+		t.Errorf("Round trip through gob should answer an equal bitset")
+	}
+	if h.Nil != nil {
+		t.Errorf("A nil bitset should remain nil through gob")
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	if _, ok := New(0).Min(); ok {
+		t.Errorf("Min of an empty bitset should fail")
+	}
+	if _, ok := New(0).Max(); ok {
+		t.Errorf("Max of an empty bitset should fail")
+	}
+
+	cases := []struct {
+		v        *BitSet
+		min, max uint64
+	}{
+		{New(0).Set(0), 0, 0},
+		{New(0).Set(63), 63, 63},
+		{New(0).Set(5).Set(40), 5, 40},
+		{New(0).Set(70).Set(1000).Set(1 << 40), 70, 1 << 40},
+		{New(0).Set(math.MaxUint64).Set(64), 64, math.MaxUint64},
+	}
+	for _, c := range cases {
+		if min, ok := c.v.Min(); !ok || min != c.min {
+			t.Errorf("Min should be %d, but is %d", c.min, min)
+		}
+		if max, ok := c.v.Max(); !ok || max != c.max {
+			t.Errorf("Max should be %d, but is %d", c.max, max)
+		}
+	}
+}
+
+func TestShift(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	v := New(0).Set(0).Set(63).Set(64).Set(math.MaxUint64 - 3)
+	for i := 0; i < 500; i++ {
+		v.Set(uint64(r.Int63n(1 << 16)))
+	}
+	bits := v.ToSlice()
+
+	for _, n := range []uint64{0, 1, 3, 63, 64, 65, 128, 200, 1000, 1 << 16, math.MaxUint64 - 10} {
+		left, right := New(0), New(0)
+		for _, i := range bits {
+			if i+n >= i {
+				left.Set(i + n)
+			}
+			if i >= n {
+				right.Set(i - n)
+			}
+		}
+
+		if u := v.Clone().ShiftLeft(n); !u.Equal(left) {
+			t.Errorf("ShiftLeft(%d) mismatch", n)
+		}
+		if u := v.Clone().ShiftRight(n); !u.Equal(right) {
+			t.Errorf("ShiftRight(%d) mismatch", n)
+		}
+	}
+
+	if !New(0).ShiftLeft(5).None() || !New(0).ShiftRight(5).None() {
+		t.Errorf("Shifting an empty bitset should answer an empty bitset")
+	}
+}
+
+func TestIntersects(t *testing.T) {
+	a := New(0).SetRange(0, 100)
+	b := New(0).SetRange(100, 200)
+	c := New(0).SetRange(50, 150)
+
+	if a.Intersects(b) || b.Intersects(a) {
+		t.Errorf("Disjoint bitsets should not intersect")
+	}
+	if !a.Intersects(c) || !c.Intersects(b) {
+		t.Errorf("Overlapping bitsets should intersect")
+	}
+	if !a.Intersects(a.Clone()) {
+		t.Errorf("Identical non-empty bitsets should intersect")
+	}
+
+	// Common offsets, but no common bits.
+	if New(0).Set(1).Set(1000).Intersects(New(0).Set(2).Set(1001)) {
+		t.Errorf("Bitsets sharing only offsets should not intersect")
+	}
+	if a.Intersects(nil) || a.Intersects(New(0)) || New(0).Intersects(New(0)) {
+		t.Errorf("An empty or nil bitset should not intersect anything")
+	}
+}
+
+func TestIsSubSet(t *testing.T) {
+	a := New(500)
+	b := New(300)
+	c := New(200)
+
+	// Setup bitsets
+	// a and b overlap
+	// a and b are (strict) subsets of c
+	for i := uint64(0); i < 100; i++ {
+		a.Set(i)
+	}
+	for i := uint64(50); i < 150; i++ {
+		b.Set(i)
+	}
+	for i := uint64(0); i < 200; i++ {
+		c.Set(i)
+	}
+
+	if a.IsSubSet(b) == true {
+		t.Errorf("IsSubSet fails")
+	}
+	if c.IsSubSet(a) == true {
+		t.Errorf("IsSubSet fails")
+	}
+	if b.IsSubSet(a) == true {
+		t.Errorf("IsSubSet fails")
+	}
+	if c.IsSubSet(b) == true {
+		t.Errorf("IsSubSet fails")
+	}
+	if a.IsSubSet(c) != true {
+		t.Errorf("IsSubSet fails")
+	}
+	if b.IsSubSet(c) != true {
+		t.Errorf("IsSubSet fails")
+	}
+
+	if a.IsStrictSubSet(b) == true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+	if c.IsStrictSubSet(a) == true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+	if b.IsStrictSubSet(a) == true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+	if c.IsStrictSubSet(b) == true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+	if a.IsStrictSubSet(c) != true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+	if b.IsStrictSubSet(c) != true {
+		t.Errorf("IsStrictSubSet fails")
+	}
+
+	if a.IsSubSet(a.Clone()) != true || a.IsStrictSubSet(a.Clone()) == true {
+		t.Errorf("A bitset should be a subset, but not a strict subset, of itself")
+	}
+	e := New(0)
+	if e.IsSubSet(a) != true || e.IsSubSet(nil) != true || e.IsStrictSubSet(a) != true {
+		t.Errorf("An empty bitset should be a subset of every bitset")
+	}
+	if e.IsStrictSubSet(nil) == true || e.IsStrictSubSet(New(0)) == true {
+		t.Errorf("An empty bitset should not be a strict subset of an empty bitset")
+	}
+	if a.IsSubSet(nil) == true {
+		t.Errorf("A non-empty bitset should not be a subset of nil")
+	}
+}
+
+func TestTestAndSetClear(t *testing.T) {
+	v := New(0)
+	if v.TestAndSet(100) != false || v.TestAndSet(100) != true || !v.Test(100) {
+		t.Errorf("TestAndSet should answer the prior value and set the bit")
+	}
+	if v.TestAndSet(101) != false || v.Cardinality() != 2 || len(v.set) != 1 {
+		t.Errorf("TestAndSet should set a bit in an existing block")
+	}
+
+	if v.TestAndClear(5000) != false || len(v.set) != 1 {
+		t.Errorf("TestAndClear of an unset bit should answer false, and create no block")
+	}
+	if v.TestAndClear(102) != false || v.Cardinality() != 2 {
+		t.Errorf("TestAndClear of an unset bit in an existing block should answer false")
+	}
+	if v.TestAndClear(100) != true || v.Test(100) {
+		t.Errorf("TestAndClear should answer the prior value and clear the bit")
+	}
+	if v.TestAndClear(101) != true || len(v.set) != 0 {
+		t.Errorf("TestAndClear should remove a block that becomes empty")
+	}
+}
+
+func TestSetClearFlipMany(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	base := New(0)
+	for i := 0; i < 300; i++ {
+		base.Set(uint64(r.Int63n(20000)))
+	}
+	ns := make([]uint64, 400)
+	for i := range ns {
+		ns[i] = uint64(r.Int63n(30000))
+	}
+	distinct := NewFromSlice(ns).ToSlice()
+
+	set, clear, flip := base.Clone(), base.Clone(), base.Clone()
+	for _, n := range ns {
+		set.Set(n)
+		clear.Clear(n)
+	}
+	for _, n := range distinct {
+		if flip.Test(n) {
+			flip.Clear(n)
+		} else {
+			flip.Set(n)
+		}
+	}
+
+	if !base.Clone().SetMany(ns...).Equal(set) {
+		t.Errorf("SetMany should match chained Set calls")
+	}
+	if !base.Clone().ClearMany(ns...).Equal(clear) {
+		t.Errorf("ClearMany should match chained Clear calls")
+	}
+	dup := append(append([]uint64(nil), distinct...), distinct...)
+	if !base.Clone().FlipMany(dup...).Equal(flip) {
+		t.Errorf("FlipMany should invert each distinct position once")
+	}
+
+	if !New(0).SetMany(3, 1, 2).Equal(New(0).Set(1).Set(2).Set(3)) {
+		t.Errorf("SetMany(3, 1, 2) should match chained Set calls")
+	}
+	if !New(0).Set(1).ClearMany(1, 1).None() {
+		t.Errorf("ClearMany should drop emptied blocks")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	v := New(0).Set(1 << 40).Set(0).Set(64).Set(63).Set(1000)
+	var got []uint64
+	v.ForEach(func(i uint64) bool {
+		got = append(got, i)
+		return true
+	})
+	exp := []uint64{0, 63, 64, 1000, 1 << 40}
+	if len(got) != len(exp) {
+		t.Fatalf("ForEach should visit %d bits, but visited %d", len(exp), len(got))
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("ForEach visited %d at position %d, expected %d", got[i], i, exp[i])
+		}
+	}
+
+	n := 0
+	v.ForEach(func(i uint64) bool {
+		n++
+		return i < 63
+	})
+	if n != 2 {
+		t.Errorf("ForEach should stop when the function answers false; visited %d", n)
+	}
+
+	New(0).ForEach(func(uint64) bool {
+		t.Errorf("ForEach over an empty bitset should not invoke the function")
+		return true
+	})
+}
+
+func TestClearFrom(t *testing.T) {
+	base := New(0).SetRange(0, 200).Set(1000).Set(5000)
+
+	for _, n := range []uint64{0, 1, 70, 128, 150, 200, 1000, 1001, 6000} {
+		exp := base.Clone()
+		for _, i := range base.ToSlice() {
+			if i >= n {
+				exp.Clear(i)
+			}
+		}
+
+		v := base.Clone().ClearFrom(n)
+		if !v.Equal(exp) {
+			t.Errorf("ClearFrom(%d) mismatch: %v", n, v)
+		}
+		for _, el := range v.set {
+			if el.Bits == 0 {
+				t.Errorf("ClearFrom(%d) left an empty block", n)
+			}
+		}
+		if !base.Clone().Truncate(n).Equal(exp) {
+			t.Errorf("Truncate(%d) should match ClearFrom", n)
+		}
+	}
+
+	// Cutting exactly on a word boundary drops the block at it.
+	if v := base.Clone().ClearFrom(128); len(v.set) != 2 {
+		t.Errorf("ClearFrom on a word boundary should leave 2 blocks, but left %d", len(v.set))
+	}
+	// Beyond the highest set bit, it is a no-op.
+	if !base.Clone().ClearFrom(5001).Equal(base) {
+		t.Errorf("ClearFrom beyond the highest set bit should be a no-op")
+	}
+}
+
+func TestComplementWithin(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	for _, m := range []uint64{0, 1, 37, 64, 100, 128, 1000, 4097} {
+		a := New(0)
+		for i := 0; i < 50 && m > 0; i++ {
+			a.Set(uint64(r.Int63n(int64(m))))
+		}
+
+		c := a.ComplementWithin(m)
+		if c.Cardinality() != m-a.Cardinality() || c.Intersects(a) {
+			t.Errorf("ComplementWithin(%d) should hold exactly the bits missing from a", m)
+		}
+		if x, ok := c.Max(); ok && x >= m {
+			t.Errorf("ComplementWithin(%d) should not set bit %d", m, x)
+		}
+		if !c.ComplementWithin(m).Equal(a) {
+			t.Errorf("ComplementWithin(%d) twice should answer the original bitset", m)
+		}
+
+		u := New(0)
+		for i := 0; i < 50 && m > 0; i++ {
+			u.Set(uint64(r.Int63n(int64(m))))
+		}
+		if !a.Agreement(u, m).Equal(a.SymmetricDifference(u).ComplementWithin(m)) {
+			t.Errorf("Agreement within %d should complement the symmetric difference", m)
+		}
+	}
+
+	if !New(0).Set(5).Set(500).ComplementWithin(10).Equal(New(0).SetRange(0, 10).Clear(5)) {
+		t.Errorf("ComplementWithin should drop bits beyond its bound")
+	}
+}
+
+func TestHammingJaccardSimilarity(t *testing.T) {
+	a := New(0).Set(1).Set(2).Set(3).Set(100)
+	b := New(0).Set(2).Set(3).Set(4).Set(5000)
+
+	if d, err := a.HammingDistance(b); err != nil || d != 4 {
+		t.Errorf("HammingDistance should be 4, but is %d (%v)", d, err)
+	}
+	if d, _ := a.HammingDistance(a.Clone()); d != 0 {
+		t.Errorf("HammingDistance to itself should be 0, but is %d", d)
+	}
+	if j, err := a.JaccardSimilarity(b); err != nil || j != 2.0/6.0 {
+		t.Errorf("JaccardSimilarity should be 1/3, but is %f (%v)", j, err)
+	}
+	if j, _ := New(0).JaccardSimilarity(New(0)); j != 1 {
+		t.Errorf("JaccardSimilarity of two empty bitsets should be 1, but is %f", j)
+	}
+
+	if _, err := a.HammingDistance(nil); err != ErrNilArgument {
+		t.Errorf("HammingDistance(nil) should answer ErrNilArgument, got %v", err)
+	}
+	if _, err := a.JaccardSimilarity(nil); err != ErrNilArgument {
+		t.Errorf("JaccardSimilarity(nil) should answer ErrNilArgument, got %v", err)
+	}
+}
+
+func TestValid(t *testing.T) {
+	good := New(0).Set(1).Set(1000).Set(70000)
+	if err := good.Valid(); err != nil {
+		t.Errorf("A well-formed bitset should be valid, got %v", err)
+	}
+	if err := New(0).Valid(); err != nil {
+		t.Errorf("An empty bitset should be valid, got %v", err)
+	}
+
+	cases := []struct {
+		set blockAry
+		err error
+	}{
+		{blockAry{{5, 1}, {3, 1}}, ErrBlocksOutOfOrder},
+		{blockAry{{3, 1}, {3, 2}}, ErrBlocksOutOfOrder},
+		{blockAry{{3, 1}, {4, 0}}, ErrEmptyBlock},
+		{blockAry{{0, 0}}, ErrEmptyBlock},
+	}
+	for _, c := range cases {
+		v := &BitSet{set: c.set}
+		if err := v.Valid(); err != c.err {
+			t.Errorf("Valid(%v) should answer %v, got %v", c.set, c.err, err)
+		}
+
+		var buf bytes.Buffer
+		v.WriteTo(&buf)
+		data := buf.Bytes()
+
+		ValidateOnRead = false
+		u := New(0)
+		if _, err := u.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Errorf("ReadFrom should not validate by default, got %v", err)
+		}
+
+		ValidateOnRead = true
+		u = good.Clone()
+		if _, err := u.ReadFrom(bytes.NewReader(data)); err != c.err || !u.Equal(good) {
+			t.Errorf("ReadFrom should reject %v with %v, got %v", c.set, c.err, err)
+		}
+		buf.Reset()
+		v.WriteToChecked(&buf)
+		if _, err := u.ReadFromChecked(&buf); err != c.err || !u.Equal(good) {
+			t.Errorf("ReadFromChecked should reject %v with %v, got %v", c.set, c.err, err)
+		}
+		ValidateOnRead = false
+	}
+}
+
+func TestCardinalityCache(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	v := New(0)
+	other := New(0)
+	for i := 0; i < 200; i++ {
+		other.Set(uint64(r.Int63n(5000)))
+	}
+
+	ops := []func(){
+		func() { v.Set(uint64(r.Int63n(5000))) },
+		func() { v.Clear(uint64(r.Int63n(5000))) },
+		func() { v.Flip(uint64(r.Int63n(5000))) },
+		func() { v.TestAndSet(uint64(r.Int63n(5000))) },
+		func() { v.TestAndClear(uint64(r.Int63n(5000))) },
+		func() { v.SetRange(uint64(r.Int63n(5000)), 5000) },
+		func() { v.ClearRange(uint64(r.Int63n(5000)), 5000) },
+		func() { v.FlipRange(uint64(r.Int63n(5000)), 5000) },
+		func() { v.SetMany(uint64(r.Int63n(5000)), uint64(r.Int63n(5000))) },
+		func() { v.ClearFrom(uint64(r.Int63n(6000))) },
+		func() { v.InPlaceUnion(other) },
+		func() { v.InPlaceIntersection(other.Clone().SetRange(0, 2500)) },
+		func() { v.InPlaceDifference(other) },
+		func() { v.InPlaceSymmetricDifference(other) },
+		func() { v.ShiftLeft(uint64(r.Int63n(100))) },
+		func() { v.ShiftRight(uint64(r.Int63n(100))) },
+		func() { v.ApplyOps([]Op{{10, true}, {20, false}}) },
+		func() { v.ApplyDelta(other, New(0).Set(7)) },
+		func() { other.Copy(v) },
+		func() { v = v.Clone() },
+		func() { v.ClearAll() },
+	}
+	for i := 0; i < 2000; i++ {
+		ops[r.Intn(len(ops))]()
+		if c, exp := v.Cardinality(), popcountSet(v.set); c != exp {
+			t.Fatalf("Cached cardinality %d should match a fresh popcount %d", c, exp)
+		}
+	}
+
+	// Reading over a bitset must refresh its cache.
+	var buf bytes.Buffer
+	other.WriteTo(&buf)
+	v.Cardinality()
+	v.ReadFrom(&buf)
+	if v.Cardinality() != other.Cardinality() {
+		t.Errorf("ReadFrom should invalidate the cached cardinality")
+	}
+
+	// The set-algebra constructors count as they build the result.
+	v = New(0).SetRange(100, 3000)
+	for _, res := range []*BitSet{
+		v.Union(other), v.Intersection(other), v.Difference(other), v.SymmetricDifference(other),
+		UnionMany(v, other), IntersectionMany(v, other), v.DifferenceMany(other),
+	} {
+		if res.cardOK != 1 || res.card != popcountSet(res.set) {
+			t.Errorf("Constructed set should have a valid cached cardinality: %d vs %d", res.card, popcountSet(res.set))
+		}
+	}
+}
+
+// TestConcurrentReads reads a shared bitset, whose cached cardinality
+// is stale, from several goroutines.  Run it with `-race`.
+func TestConcurrentReads(t *testing.T) {
+	v := New(0).SetRange(0, 64*minShardBlocks*2).Set(1 << 40)
+	other := New(0).SetRange(100, 5000)
+	v.invalidate()
+	other.invalidate()
+	exp := popcountSet(v.set)
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for k := 0; k < 8; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			if k%2 == 0 && v.CardinalityParallel(4) != exp {
+				errs <- "CardinalityParallel"
+			}
+			if v.Count() != exp || v.Stats().Bits != exp || v.Clone().Count() != exp {
+				errs <- "Count"
+			}
+			v.Copy(New(0))
+			v.JaccardAtLeast(other, 0.5)
+			other.JaccardAtLeast(v, 0.5)
+			v.ApproxCardinality(10, rand.New(rand.NewSource(int64(k))))
+			v.Union(other).Count()
+		}(k)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Errorf("%s answered a wrong cardinality under concurrent reads", e)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	var _ driver.Valuer = (*BitSet)(nil)
+	var _ sql.Scanner = (*BitSet)(nil)
+
+	for _, v := range []*BitSet{New(0), New(0).Set(1).Set(1000).SetRange(5000, 9000)} {
+		dv, err := v.Value()
+		if err != nil {
+			t.Fatalf("Value failed: %v", err)
+		}
+		data, ok := dv.([]byte)
+		if !ok || !driver.IsValue(dv) {
+			t.Fatalf("Value should answer a []byte, but answered %T", dv)
+		}
+
+		u := New(0).Set(3)
+		if err = u.Scan(data); err != nil || !u.Equal(v) {
+			t.Errorf("Round trip through Value and Scan failed: %v", err)
+		}
+		u = New(0).Set(3)
+		if err = u.Scan(string(data)); err != nil || !u.Equal(v) {
+			t.Errorf("Scan of a string failed: %v", err)
+		}
+	}
+
+	if dv, err := (*BitSet)(nil).Value(); dv != nil || err != nil {
+		t.Errorf("Value of a nil bitset should be NULL")
+	}
+	u := New(0).Set(3)
+	if err := u.Scan(nil); err != nil || !u.None() {
+		t.Errorf("Scan of NULL should answer an empty bitset: %v", err)
+	}
+	if err := u.Scan(42); err != ErrUnsupportedType {
+		t.Errorf("Scan of an int should answer ErrUnsupportedType, got %v", err)
+	}
+	if err := u.Scan([]byte{0xf2, 0, 0}); err == nil {
+		t.Errorf("Scan of truncated data should fail")
+	}
+}
+
+func TestWriteToCompressed(t *testing.T) {
+	r := rand.New(rand.NewSource(10))
+	clustered := New(0).SetRange(0, 100000).SetRange(1<<30, 1<<30+50000)
+	for i := 0; i < 100; i++ {
+		clustered.Set(uint64(r.Int63n(1 << 40)))
+	}
+	random := New(0)
+	for i := 0; i < 1000; i++ {
+		random.Set(uint64(r.Int63n(1 << 20)))
+	}
+
+	for _, v := range []*BitSet{New(0), New(0).Set(0), New(0).Set(math.MaxUint64), clustered, random} {
+		var buf bytes.Buffer
+		n, err := v.WriteToCompressed(&buf)
+		if err != nil || n != int64(buf.Len()) {
+			t.Fatalf("WriteToCompressed wrote %d bytes, with error %v", n, err)
+		}
+		buf.WriteString("trailer")
+
+		u := New(0).Set(3)
+		m, err := u.ReadFromCompressed(&buf)
+		if err != nil || m != n || !u.Equal(v) {
+			t.Errorf("Round trip through WriteToCompressed failed: %v (%d of %d bytes)", err, m, n)
+		}
+		if buf.String() != "trailer" {
+			t.Errorf("ReadFromCompressed should not read beyond its data")
+		}
+	}
+
+	var buf bytes.Buffer
+	clustered.WriteToCompressed(&buf)
+	if buf.Len()*20 > clustered.BinaryStorageSize() {
+		t.Errorf("Compressed form of a clustered bitset should be much smaller: %d vs %d bytes",
+			buf.Len(), clustered.BinaryStorageSize())
+	}
+
+	data := buf.Bytes()
+	for i := 0; i < len(data); i++ {
+		if _, err := New(0).ReadFromCompressed(bytes.NewReader(data[:i])); err == nil {
+			t.Errorf("ReadFromCompressed should reject data truncated to %d bytes", i)
+		}
+	}
+	bad := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0xf2, 0}, ErrUnknownFormat},
+		{[]byte{0xf3, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, ErrInvalidLength},
+		{[]byte{0xf3, 1, 0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0, 0, 0, 0, 0, 0, 0, 1}, ErrInvalidLength},
+		{[]byte{0xf3, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, ErrEmptyBlock},
+		{[]byte{0xf3, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 1, 0, 0, 0, 0, 0, 0, 0, 1}, ErrInvalidIndex},
+	}
+	for _, c := range bad {
+		if _, err := New(0).ReadFromCompressed(bytes.NewReader(c.data)); err != c.err {
+			t.Errorf("ReadFromCompressed(%v) should answer %v, got %v", c.data, c.err, err)
+		}
+	}
+}
+
+func TestWriteToHeader(t *testing.T) {
+	v := New(0).Set(1).Set(1000)
+	var buf bytes.Buffer
+	v.WriteTo(&buf)
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, append(magic[:], formatVersion)) {
+		t.Fatalf("WriteTo should begin with the magic number and version: %v", data[:headerSize])
+	}
+
+	u := New(0)
+	if _, err := u.ReadFrom(bytes.NewReader(data)); err != nil || !u.Equal(v) {
+		t.Errorf("ReadFrom should accept a good header, got %v", err)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[1] = 'X'
+	if _, err := u.ReadFrom(bytes.NewReader(bad)); err != ErrBadMagic {
+		t.Errorf("ReadFrom should reject a wrong magic number, got %v", err)
+	}
+	bad = append([]byte(nil), data...)
+	bad[len(magic)] = formatVersion + 1
+	if _, err := u.ReadFrom(bytes.NewReader(bad)); err != ErrUnsupportedVersion {
+		t.Errorf("ReadFrom should reject a wrong version, got %v", err)
+	}
+
+	// Arbitrary bytes are rejected before anything is allocated for
+	// them.
+	for _, junk := range []string{"hello world", "\x00", ""} {
+		if _, err := u.ReadFrom(strings.NewReader(junk)); err == nil {
+			t.Errorf("ReadFrom should reject %q", junk)
+		}
+	}
+	if _, err := u.ReadFrom(strings.NewReader("hello world")); err != ErrBadMagic {
+		t.Errorf("ReadFrom should reject plain text with ErrBadMagic, got %v", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadAuto(strings.NewReader("hello world")); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAuto should reject plain text as truncated, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if d := after.TotalAlloc - before.TotalAlloc; d > 1<<24 {
+		t.Errorf("A corrupt length should not force a large allocation, but %d bytes were allocated", d)
+	}
+
+	// Headerless data from before is rejected by `ReadFrom`, but still
+	// read by `ReadAuto`.
+	buf.Reset()
+	v.writeBody(&buf)
+	if _, err := u.ReadFrom(bytes.NewReader(buf.Bytes())); err != ErrBadMagic {
+		t.Errorf("ReadFrom should reject legacy data, got %v", err)
+	}
+	if w, err := ReadAuto(&buf); err != nil || !w.Equal(v) {
+		t.Errorf("ReadAuto should read legacy data, got %v", err)
+	}
+}
+
+func TestResetRelease(t *testing.T) {
+	v := New(0).SetRange(0, 64*100)
+	c := cap(v.set)
+
+	v.Reset()
+	if !v.None() || v.Cardinality() != 0 || cap(v.set) != c {
+		t.Errorf("Reset should clear the bitset and retain its capacity %d, got %d", c, cap(v.set))
+	}
+
+	v.SetRange(0, 64*100)
+	v.Release()
+	if !v.None() || v.Cardinality() != 0 || cap(v.set) != 0 {
+		t.Errorf("Release should clear the bitset and drop its storage, got capacity %d", cap(v.set))
+	}
+	if !v.Set(5).Test(5) {
+		t.Errorf("A released bitset should remain usable")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	v := New(0)
+	for i := uint64(0); i < 10000; i++ {
+		v.Set(i * 64)
+	}
+	v.ClearFrom(64 * 10)
+	if cap(v.set) == len(v.set) {
+		t.Fatalf("Clearing most of a bitset should leave spare capacity")
+	}
+
+	exp := New(0).SetMany(0, 64, 128, 192, 256, 320, 384, 448, 512, 576)
+	v.Compact()
+	if cap(v.set) != len(v.set) || len(v.set) != 10 {
+		t.Errorf("Compact should fit the storage to %d blocks, got len %d, cap %d",
+			10, len(v.set), cap(v.set))
+	}
+	if !v.Equal(exp) {
+		t.Errorf("Compact should not alter the bitset")
+	}
+	if !New(0).Compact().None() {
+		t.Errorf("Compact of an empty bitset should be empty")
+	}
+}
+
+func TestUnionIntersectionMany(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	sets := make([]*BitSet, 8)
+	for k := range sets {
+		sets[k] = New(0).SetRange(0, 2000)
+		for i := 0; i < 3000; i++ {
+			sets[k].Clear(uint64(r.Int63n(2000)))
+			sets[k].Set(uint64(r.Int63n(100000)))
+		}
+	}
+
+	for n := 1; n <= len(sets); n++ {
+		u, x := sets[0].Clone(), sets[0].Clone()
+		for _, b := range sets[1:n] {
+			u = u.Union(b)
+			x = x.Intersection(b)
+		}
+		if !UnionMany(sets[:n]...).Equal(u) {
+			t.Errorf("UnionMany of %d bitsets should match pairwise unions", n)
+		}
+		if got := IntersectionMany(sets[:n]...); !got.Equal(x) {
+			t.Errorf("IntersectionMany of %d bitsets should match pairwise intersections", n)
+		}
+	}
+
+	a, b := New(0).SetMany(1, 2, 70), New(0).SetMany(2, 70, 5000)
+	if !UnionMany(a, nil, New(0), b).Equal(a.Union(b)) {
+		t.Errorf("UnionMany should ignore nil and empty bitsets")
+	}
+	if !IntersectionMany(a, b).Equal(New(0).SetMany(2, 70)) {
+		t.Errorf("IntersectionMany of two bitsets is wrong")
+	}
+	if !IntersectionMany(a, nil).None() || !IntersectionMany(a, New(0)).None() {
+		t.Errorf("IntersectionMany with a nil or empty bitset should be empty")
+	}
+	if !UnionMany().None() || !IntersectionMany().None() {
+		t.Errorf("UnionMany and IntersectionMany of no bitsets should be empty")
+	}
+}
+
+func TestCardinalityMany(t *testing.T) {
+	r := rand.New(rand.NewSource(14))
+	base := New(0).SetRange(0, 3000)
+	cands := make([]*BitSet, 6)
+	for k := range cands {
+		cands[k] = New(0).SetRange(uint64(k)*100, 2500+uint64(k)*100)
+		for i := 0; i < 1000; i++ {
+			cands[k].Set(uint64(r.Int63n(100000)))
+		}
+	}
+
+	for n := 0; n <= len(cands); n++ {
+		u, x := base.Clone(), base.Clone()
+		for _, c := range cands[:n] {
+			u = u.Union(c)
+			x = x.Intersection(c)
+		}
+		if c, err := base.UnionCardinalityMany(cands[:n]...); err != nil || c != u.Cardinality() {
+			t.Errorf("UnionCardinalityMany of %d bitsets should be %d, got %d, %v", n, u.Cardinality(), c, err)
+		}
+		if c, err := base.IntersectionCardinalityMany(cands[:n]...); err != nil || c != x.Cardinality() {
+			t.Errorf("IntersectionCardinalityMany of %d bitsets should be %d, got %d, %v", n, x.Cardinality(), c, err)
+		}
+	}
+
+	if c, err := New(0).IntersectionCardinalityMany(base); err != nil || c != 0 {
+		t.Errorf("Intersection with an empty set should be 0, got %d, %v", c, err)
+	}
+	if c, err := New(0).UnionCardinalityMany(New(0), base); err != nil || c != 3000 {
+		t.Errorf("Expected a union cardinality of 3000, got %d, %v", c, err)
+	}
+	if _, err := base.UnionCardinalityMany(cands[0], nil); err != ErrNilArgument {
+		t.Errorf("Expected ErrNilArgument, got %v", err)
+	}
+	if _, err := base.IntersectionCardinalityMany(nil); err != ErrNilArgument {
+		t.Errorf("Expected ErrNilArgument, got %v", err)
+	}
+}
+
+func TestDifferenceMany(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	allowed := New(0).SetRange(0, 5000)
+	for i := 0; i < 2000; i++ {
+		allowed.Set(uint64(r.Int63n(100000)))
+	}
+
+	// Overlapping subtrahends, plus a disjoint one beyond `allowed`.
+	denied := make([]*BitSet, 6)
+	for k := range denied[:5] {
+		denied[k] = New(0).SetRange(uint64(k)*700, uint64(k)*700+1000)
+		for i := 0; i < 500; i++ {
+			denied[k].Set(uint64(r.Int63n(100000)))
+		}
+	}
+	denied[5] = New(0).SetRange(1<<30, 1<<30+100)
+
+	for n := 0; n <= len(denied); n++ {
+		want := allowed.Clone()
+		for _, c := range denied[:n] {
+			want = want.Difference(c)
+		}
+		if got := allowed.DifferenceMany(denied[:n]...); !got.Equal(want) {
+			t.Errorf("DifferenceMany of %d bitsets should match pairwise differences", n)
+		}
+	}
+
+	a := New(0).SetMany(1, 2, 70, 5000)
+	if !a.DifferenceMany(nil, New(0).Set(2), nil, New(0).Set(5000)).Equal(New(0).SetMany(1, 70)) {
+		t.Errorf("DifferenceMany should skip nil bitsets")
+	}
+	if !a.DifferenceMany(a, a).None() {
+		t.Errorf("DifferenceMany of a bitset from itself should be empty")
+	}
+	if !a.DifferenceMany().Equal(a) {
+		t.Errorf("DifferenceMany of no bitsets should equal the original")
+	}
+}
+
+func TestPop(t *testing.T) {
+	r := rand.New(rand.NewSource(12))
+	v := New(0).Set(0).Set(63).Set(64)
+	for i := 0; i < 500; i++ {
+		v.Set(uint64(r.Int63n(1 << 20)))
+	}
+	exp := v.ToSlice()
+
+	for k, e := range exp {
+		n, ok := v.Pop()
+		if !ok || n != e {
+			t.Fatalf("Pop #%d should answer %d, but answered %d (%v)", k, e, n, ok)
+		}
+		if v.Test(n) || v.Cardinality() != uint64(len(exp)-k-1) {
+			t.Fatalf("Pop should clear the bit it answers")
+		}
+	}
+	if _, ok := v.Pop(); ok || !v.None() || len(v.set) != 0 {
+		t.Errorf("Pop should leave an empty bitset, and then fail")
+	}
+}
+
+func TestSetAliases(t *testing.T) {
+	v := New(0)
+	if v.Add(10).Add(1000) != v || !v.Contains(10) || !v.Contains(1000) || v.Contains(11) {
+		t.Errorf("Add and Contains should behave as Set and Test")
+	}
+	if v.Remove(10) != v || v.Contains(10) || !v.Equal(New(0).Set(1000)) {
+		t.Errorf("Remove should behave as Clear")
+	}
+}
+
+func TestContainsRange(t *testing.T) {
+	v := New(0).SetRange(10, 1000).SetRange(2000, 2100)
+
+	cases := []struct {
+		lo, hi uint64
+		exp    bool
+	}{
+		{10, 1000, true},
+		{10, 11, true},
+		{63, 65, true},
+		{64, 128, true},
+		{500, 500, true},
+		{9, 20, false},
+		{990, 1001, false},
+		{900, 2050, false}, // spans a gap between blocks
+		{2000, 2100, true},
+		{5000, 5001, false},
+		{20, 10, false},
+	}
+	for _, c := range cases {
+		if got := v.ContainsRange(c.lo, c.hi); got != c.exp {
+			t.Errorf("ContainsRange(%d, %d) should be %v", c.lo, c.hi, c.exp)
+		}
+	}
+
+	v.Clear(700)
+	if v.ContainsRange(10, 1000) || !v.ContainsRange(10, 700) || !v.ContainsRange(701, 1000) {
+		t.Errorf("ContainsRange should detect a single hole")
+	}
+}
+
+func TestAnyInRange(t *testing.T) {
+	v := New(0).Set(100).Set(5000).SetRange(10000, 10010)
+
+	cases := []struct {
+		lo, hi uint64
+		exp    bool
+	}{
+		{0, 0, false},
+		{100, 100, false},
+		{101, 4999, false}, // inside a gap
+		{200, 300, false},
+		{100, 101, true},
+		{0, 101, true},
+		{50, 100, false},
+		{5000, 6000, true},
+		{4000, 5001, true},
+		{4000, 5000, false},
+		{10009, 20000, true},
+		{10010, 20000, false},
+		{101, 100, false},
+	}
+	for _, c := range cases {
+		if got := v.AnyInRange(c.lo, c.hi); got != c.exp {
+			t.Errorf("AnyInRange(%d, %d) should be %v", c.lo, c.hi, c.exp)
+		}
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	for k := 0; k < 20; k++ {
+		v := New(0)
+		for i := 0; i < k*10; i++ {
+			v.Set(uint64(r.Int63n(1 << uint(4+k%12))))
+		}
+
+		x := v.BigInt()
+		if m, ok := v.Max(); ok && uint64(x.BitLen()) != m+1 {
+			t.Errorf("BigInt should have a bit length of %d, but has %d", m+1, x.BitLen())
+		}
+		for i := uint64(0); i < 1<<15; i++ {
+			if v.Test(i) != (x.Bit(int(i)) == 1) {
+				t.Fatalf("Bit %d of BigInt should mirror the bitset", i)
+			}
+		}
+		if !FromBigInt(x).Equal(v) {
+			t.Errorf("Round trip through BigInt should answer an equal bitset")
+		}
+	}
+
+	x, _ := new(big.Int).SetString("80000000000000000000000000000005", 16)
+	v := FromBigInt(x)
+	if !v.Equal(New(0).SetMany(0, 2, 127)) {
+		t.Errorf("FromBigInt(%x) should set bits 0, 2 and 127, but is %v", x, v)
+	}
+	if New(0).BigInt().Sign() != 0 || !FromBigInt(new(big.Int)).None() {
+		t.Errorf("An empty bitset should correspond to zero")
+	}
+	if FromBigInt(big.NewInt(-5)) != nil || FromBigInt(nil) != nil {
+		t.Errorf("FromBigInt should reject negative and nil integers")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	if buf := New(0).Bytes(); buf == nil || len(buf) != 0 {
+		t.Errorf("Bytes of an empty bitset should be an empty slice")
+	}
+
+	r := rand.New(rand.NewSource(14))
+	v := New(0).Set(0).Set(7).Set(8).Set(1 << 14)
+	for i := 0; i < 300; i++ {
+		v.Set(uint64(r.Int63n(1 << 14)))
+	}
+	buf := v.Bytes()
+	if len(buf) != (1<<14)/8+1 {
+		t.Errorf("Bytes should be sized to the highest set bit, but has %d bytes", len(buf))
+	}
+	for i := uint64(0); i < uint64(len(buf))*8; i++ {
+		if v.Test(i) != (buf[i/8]&(1<<(i%8)) != 0) {
+			t.Fatalf("Bit %d should be at bit %d of byte %d", i, i%8, i/8)
+		}
+	}
+	if !FromBytes(buf).Equal(v) {
+		t.Errorf("Round trip through Bytes should answer an equal bitset")
+	}
+	if !FromBytes([]byte{0x81, 0, 0x02}).Equal(New(0).SetMany(0, 7, 17)) {
+		t.Errorf("FromBytes should place bit i at bit i%%8 of byte i/8")
+	}
+}
+
+// fuzzOperand answers a small bitset, and its reference, straddling
+// the word boundary nearest the given position.
+func fuzzOperand(pos uint64) (*BitSet, map[uint64]bool) {
+	c := New(0)
+	m := make(map[uint64]bool)
+	for _, n := range []uint64{pos, pos + 1, pos | modWordSize, (pos | modWordSize) + 1} {
+		c.Set(n)
+		m[n] = true
+	}
+	return c, m
+}
+
+// go test -fuzz=FuzzOperations
+func FuzzOperations(f *testing.F) {
+	// Each operation is three bytes: an opcode, and a little-endian
+	// 16-bit position.
+	f.Add([]byte{0, 0, 0, 2, 0, 0, 1, 0, 0})
+	f.Add([]byte{0, 63, 0, 0, 64, 0, 2, 63, 0, 2, 64, 0})
+	f.Add([]byte{2, 0, 0, 3, 62, 0, 4, 0, 0, 5, 127, 0})
+	f.Add([]byte{0, 128, 0, 0, 0, 0, 1, 128, 0, 3, 0, 0, 5, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b := New(0)
+		ref := make(map[uint64]bool)
+		for ; len(data) >= 3; data = data[3:] {
+			op := data[0] % 6
+			pos := uint64(data[1]) | uint64(data[2])<<8
+
+			switch op {
+			case 0:
+				b.Set(pos)
+				ref[pos] = true
+			case 1:
+				b.Clear(pos)
+				delete(ref, pos)
+			case 2:
+				b.Flip(pos)
+				if ref[pos] {
+					delete(ref, pos)
+				} else {
+					ref[pos] = true
+				}
+			case 3:
+				c, m := fuzzOperand(pos)
+				b = b.Union(c)
+				for n := range m {
+					ref[n] = true
+				}
+			case 4:
+				c, m := fuzzOperand(pos)
+				b = b.Intersection(c)
+				for n := range ref {
+					if !m[n] {
+						delete(ref, n)
+					}
+				}
+			case 5:
+				c, m := fuzzOperand(pos)
+				b = b.Difference(c)
+				for n := range m {
+					delete(ref, n)
+				}
+			}
+
+			if b == nil {
+				t.Fatalf("operation %d at %d answered nil", op, pos)
+			}
+			want := make([]uint64, 0, len(ref))
+			for n := range ref {
+				want = append(want, n)
+			}
+			slices.Sort(want)
+			if got := b.ToSlice(); !slices.Equal(got, want) {
+				t.Fatalf("after operation %d at %d: expected %v, got %v", op, pos, want, got)
+			}
+			if c := b.Cardinality(); c != uint64(len(ref)) {
+				t.Fatalf("after operation %d at %d: expected cardinality %d, got %d", op, pos, len(ref), c)
+			}
+			for _, n := range []uint64{pos, pos + 1, pos | modWordSize} {
+				if b.Test(n) != ref[n] {
+					t.Fatalf("after operation %d at %d: bit %d should be %v", op, pos, n, ref[n])
+				}
+			}
+			if err := b.Valid(); err != nil {
+				t.Fatalf("after operation %d at %d: %v", op, pos, err)
+			}
+		}
+	})
+}
+
+func TestNextSetMany(t *testing.T) {
+	v := New(0)
+	for _, n := range []uint64{0, 1, 63, 64, 65, 127, 200, 1000, 1 << 20, 1<<20 + 63} {
+		v.Set(n)
+	}
+	want := v.ToSlice()
+
+	for _, size := range []int{1, 2, 3, 7, 64} {
+		buf := make([]uint64, size)
+		var got []uint64
+		for n, more := uint64(0), true; more; {
+			var part []uint64
+			n, part, more = v.NextSetMany(n, buf)
+			if len(part) == 0 || len(part) > size || &part[0] != &buf[0] {
+				t.Fatalf("NextSetMany should reslice the given buffer")
+			}
+			got = append(got, part...)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Buffer of %d: expected %v, got %v", size, want, got)
+		}
+	}
+
+	buf := make([]uint64, 4)
+	if n, part, more := v.NextSetMany(65, buf); n != 1001 || !slices.Equal(part, []uint64{65, 127, 200, 1000}) || !more {
+		t.Errorf("Expected (1001, [65 127 200 1000], true), got (%d, %v, %v)", n, part, more)
+	}
+	if n, part, more := v.NextSetMany(1<<20+64, buf); n != 1<<20+64 || len(part) != 0 || more {
+		t.Errorf("Expected no indices past the maximum, got (%d, %v, %v)", n, part, more)
+	}
+	if _, part, more := v.NextSetMany(0, nil); len(part) != 0 || more {
+		t.Errorf("An empty buffer should answer no indices, and no more, got (%v, %v)", part, more)
+	}
+	for n, more, k := uint64(0), true, 0; more; k++ {
+		if k > 0 {
+			t.Fatalf("Iterating with an empty buffer should stop at once")
+		}
+		n, _, more = v.NextSetMany(n, buf[:0])
+	}
+	if _, part, more := New(0).NextSetMany(0, buf); len(part) != 0 || more {
+		t.Errorf("An empty bitset should answer no indices, got (%v, %v)", part, more)
+	}
+
+	top := New(0).Set(5).Set(math.MaxUint64 - 1).Set(math.MaxUint64)
+	var got []uint64
+	for n, more, k := uint64(0), true, 0; more; k++ {
+		if k > 3 {
+			t.Fatalf("NextSetMany should stop after the bit at math.MaxUint64")
+		}
+		var part []uint64
+		n, part, more = top.NextSetMany(n, buf[:1])
+		got = append(got, part...)
+	}
+	if !slices.Equal(got, top.ToSlice()) {
+		t.Errorf("Expected %v, got %v", top.ToSlice(), got)
+	}
+}
+
+func TestNewWith(t *testing.T) {
+	cases := []struct {
+		opts []Option
+		cap  int
+	}{
+		{nil, 1},
+		{[]Option{WithCapacityHint(0)}, 1},
+		{[]Option{WithCapacityHint(64 * 100)}, 101},
+		{[]Option{WithCapacityHint(64 * 99), WithDensity(0.5)}, 50},
+		{[]Option{WithCapacityHint(64 * 99), WithDensity(0.001)}, 1},
+		{[]Option{WithCapacityHint(64 * 99), WithDensity(0)}, 100},
+		{[]Option{WithCapacityHint(64 * 99), WithDensity(1.5)}, 100},
+		{[]Option{WithCapacityHint(math.MaxUint64)}, int(maxHintBlocks)},
+	}
+	for i, c := range cases {
+		b := NewWith(c.opts...)
+		if cap(b.set) != c.cap || len(b.set) != 0 {
+			t.Errorf("Case %d: expected capacity %d, got %d", i, c.cap, cap(b.set))
+		}
+	}
+
+	for _, n := range []uint64{0, 1, 1000, math.MaxUint64} {
+		if a, b := cap(New(n).set), cap(NewWith(WithCapacityHint(n)).set); a != b {
+			t.Errorf("New(%d) should reserve as NewWith does: %d != %d", n, a, b)
+		}
+	}
+	if !NewWith().Set(5).Equal(New(0).Set(5)) {
+		t.Errorf("NewWith should create a usable, empty bitset")
+	}
+}
+
+func TestEqualSemantic(t *testing.T) {
+	a := New(0).Set(1).Set(200).Set(1000)
+	b := a.Clone()
+	b.set = blockAry{{0, 2}, {1, 0}, {3, 1 << 8}, {10, 0}, {15, 1 << 40}, {20, 0}}
+	if a.Equal(b) {
+		t.Errorf("Equal should not see through empty blocks")
+	}
+	if !a.EqualSemantic(b) || !b.EqualSemantic(a) {
+		t.Errorf("Sets with the same bits set should be semantically equal")
+	}
+
+	b.set = append(b.set, block{21, 1})
+	if a.EqualSemantic(b) || b.EqualSemantic(a) {
+		t.Errorf("Sets with different bits set should not be semantically equal")
+	}
+
+	e := &BitSet{set: blockAry{{0, 0}, {5, 0}}}
+	if !e.EqualSemantic(New(0)) || !New(0).EqualSemantic(e) {
+		t.Errorf("A set of empty blocks should equal the empty set")
+	}
+	if a.EqualSemantic(nil) {
+		t.Errorf("No set should equal nil")
+	}
+}
+
+func TestCardinalityParallel(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	v := New(0)
+	v.set = make(blockAry, 0, 5*minShardBlocks+7)
+	for off := uint64(0); off < 5*minShardBlocks+7; off++ {
+		v.set = append(v.set, block{off * 3, r.Uint64() | 1})
+	}
+	want := popcountSet(v.set)
+
+	for _, shards := range []int{-1, 0, 1, 2, 3, 5, 8, 100} {
+		v.invalidate()
+		if c := v.CardinalityParallel(shards); c != want {
+			t.Errorf("%d shards: expected %d, got %d", shards, want, c)
+		}
+		if c := v.Cardinality(); c != want {
+			t.Errorf("%d shards: cached cardinality should be %d, got %d", shards, want, c)
+		}
+	}
+
+	s := New(0).Set(1).Set(100).Set(1000)
+	if c := s.CardinalityParallel(4); c != 3 {
+		t.Errorf("Expected cardinality 3 for a small set, got %d", c)
+	}
+}
+
+func TestForEachBlock(t *testing.T) {
+	v := New(0)
+	for _, n := range []uint64{0, 63, 64, 1000, 1 << 20, 1 << 40} {
+		v.Set(n)
+	}
+	v.set, _ = v.set.insert(block{2, 0}, 2) // a stray empty block
+
+	var offs []uint64
+	rebuilt := New(0)
+	v.ForEachBlock(func(off, bits uint64) bool {
+		if bits == 0 {
+			t.Errorf("Block at offset %d has no bits set", off)
+		}
+		if len(offs) > 0 && off <= offs[len(offs)-1] {
+			t.Errorf("Offset %d does not ascend from %d", off, offs[len(offs)-1])
+		}
+		offs = append(offs, off)
+		for w := bits; w != 0; w &= w - 1 {
+			rebuilt.Set(off*64 + trailingZeroes64(w))
+		}
+		return true
+	})
+	if !slices.Equal(offs, []uint64{0, 1, 15, 1 << 14, 1 << 34}) {
+		t.Errorf("Unexpected offsets %v", offs)
+	}
+	if !rebuilt.EqualSemantic(v) {
+		t.Errorf("Blocks should reproduce the set")
+	}
+
+	n := 0
+	v.ForEachBlock(func(uint64, uint64) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("Iteration should stop when the function answers false, but made %d calls", n)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	idx := make([]uint64, 10000)
+	for i := range idx {
+		idx[i] = uint64(r.Int63n(1 << 20))
+	}
+	idx = append(idx, 0, 63, 64, 64, 1<<40)
+	slices.Sort(idx)
+
+	var bl Builder
+	for _, n := range idx {
+		if err := bl.Add(n); err != nil {
+			t.Fatalf("Adding %d: %v", n, err)
+		}
+	}
+	b := bl.Build()
+	if !b.Equal(NewFromSlice(idx)) {
+		t.Errorf("Built set should equal that from NewFromSlice")
+	}
+	if err := b.Valid(); err != nil {
+		t.Errorf("Built set should be valid: %v", err)
+	}
+
+	if err := bl.Add(5); err != nil {
+		t.Fatalf("A built builder should be reusable: %v", err)
+	}
+	if err := bl.Add(4); err != ErrIndexOutOfOrder {
+		t.Errorf("Expected ErrIndexOutOfOrder, got %v", err)
+	}
+	c := bl.Build()
+	if !c.Equal(New(0).Set(5)) {
+		t.Errorf("Out-of-order index should leave the builder unchanged")
+	}
+	if !b.Equal(NewFromSlice(idx)) {
+		t.Errorf("Reusing the builder should not affect an earlier set")
+	}
+	if !bl.Build().IsEmpty() {
+		t.Errorf("An empty builder should build an empty set")
+	}
+}
+
+func TestHash(t *testing.T) {
+	a := New(0).Set(1).Set(200).Set(1 << 40)
+	b := NewFromSlice([]uint64{1 << 40, 200, 1})
+	if a.Hash() != b.Hash() {
+		t.Errorf("Equal sets should hash equally")
+	}
+	b.set, _ = b.set.insert(block{2, 0}, 1)
+	if a.Hash() != b.Hash() {
+		t.Errorf("Sets differing only in empty blocks should hash equally")
+	}
+	if New(0).Hash() != (&BitSet{set: blockAry{{7, 0}}}).Hash() {
+		t.Errorf("Empty sets should hash equally")
+	}
+
+	// The definition is stable; guard against accidental changes.
+	if h := New(0).Set(0).Hash(); h != 0x88201eb960ff62b2 {
+		t.Errorf("Unexpected hash %#x", h)
+	}
+
+	r := rand.New(rand.NewSource(0))
+	seen := make(map[uint64]bool)
+	for i := 0; i < 10000; i++ {
+		v := New(0)
+		for j := 0; j < 1+r.Intn(5); j++ {
+			v.Set(uint64(r.Int63n(1 << 16)))
+		}
+		seen[v.Hash()] = true
+	}
+	if len(seen) < 9900 {
+		t.Errorf("Random sets should usually hash differently, but only %d of 10000 hashes differ", len(seen))
+	}
+}
+
+func TestWriteBlocksTo(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	big := New(0)
+	for i := 0; i < 3*streamChunkBlocks+5; i++ {
+		big.Set(uint64(r.Int63n(1 << 30)))
+	}
+	for _, v := range []*BitSet{New(0), New(0).Set(0).Set(1 << 40), big} {
+		var buf bytes.Buffer
+		n, err := v.WriteBlocksTo(&buf)
+		if err != nil || n != int64(buf.Len()) || n != int64(9+16*len(v.set)) {
+			t.Fatalf("WriteBlocksTo answered %d, %v for %d bytes", n, err, buf.Len())
+		}
+		if c := binary.BigEndian.Uint64(buf.Bytes()[1:]); c != uint64(len(v.set)) {
+			t.Errorf("Expected a block count of %d, got %d", len(v.set), c)
+		}
+
+		u := New(0).Set(7)
+		m, err := u.ReadBlocksFrom(&buf)
+		if err != nil || m != n || !u.Equal(v) {
+			t.Errorf("Round trip of %d blocks failed: %d, %v", len(v.set), m, err)
+		}
+		if u.Cardinality() != v.Cardinality() {
+			t.Errorf("Expected cardinality %d, got %d", v.Cardinality(), u.Cardinality())
+		}
+	}
+
+	// A count beyond `uint32` must not be truncated: were it, this
+	// stream would read as a single block.
+	data := []byte{byte(FormatStreamed), 0, 0, 0, 1, 0, 0, 0, 1}
+	data = binary.BigEndian.AppendUint64(data, 3)
+	data = binary.BigEndian.AppendUint64(data, 1)
+	u := New(0).Set(7)
+	if _, err := u.ReadBlocksFrom(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a count of 2^32+1, got %v", err)
+	}
+	if !u.Equal(New(0).Set(7)) {
+		t.Errorf("A failed read should leave the set unchanged")
+	}
+
+	bad := func(blocks ...uint64) []byte {
+		d := binary.BigEndian.AppendUint64([]byte{byte(FormatStreamed)}, uint64(len(blocks)/2))
+		for _, w := range blocks {
+			d = binary.BigEndian.AppendUint64(d, w)
+		}
+		return d
+	}
+	if _, err := u.ReadBlocksFrom(bytes.NewReader(bad(5, 1, 5, 2))); err != ErrBlocksOutOfOrder {
+		t.Errorf("Expected ErrBlocksOutOfOrder, got %v", err)
+	}
+	if _, err := u.ReadBlocksFrom(bytes.NewReader(bad(5, 0))); err != ErrEmptyBlock {
+		t.Errorf("Expected ErrEmptyBlock, got %v", err)
+	}
+	if _, err := u.ReadBlocksFrom(bytes.NewReader([]byte{byte(FormatStandard), 0, 0, 0, 0, 0, 0, 0, 0})); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestInPlaceComplementWithin(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	for _, m := range []uint64{0, 1, 37, 63, 64, 65, 100, 128, 1000, 4097} {
+		for _, k := range []int{0, 5, 50, 5000} {
+			a := New(0)
+			for i := 0; i < k && m > 0; i++ {
+				a.Set(uint64(r.Int63n(int64(m))))
+			}
+			a.Set(m + 70) // beyond the domain
+
+			want := a.ComplementWithin(m)
+			c := a.Clone()
+			if c.InPlaceComplementWithin(m) != c || !c.Equal(want) {
+				t.Errorf("InPlaceComplementWithin(%d) should match ComplementWithin with %d bits", m, k)
+			}
+			if err := c.Valid(); err != nil {
+				t.Errorf("InPlaceComplementWithin(%d) left an invalid set: %v", m, err)
+			}
+			if c.Cardinality() != want.Cardinality() {
+				t.Errorf("Expected cardinality %d, got %d", want.Cardinality(), c.Cardinality())
+			}
+			if !c.InPlaceComplementWithin(m).Equal(a.ClearFrom(m)) {
+				t.Errorf("InPlaceComplementWithin(%d) twice should answer the original bitset", m)
+			}
+		}
+	}
+
+	v := New(0).SetRange(0, 640)
+	v.set = slices.Grow(v.set, 20)
+	p := &v.set[0]
+	v.InPlaceComplementWithin(700)
+	if &v.set[0] != p || !v.Equal(New(0).SetRange(640, 700)) {
+		t.Errorf("InPlaceComplementWithin should reuse storage that is large enough")
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	v := New(0).Set(1).Set(1000).Set(1 << 20)
+	v.set, _ = v.set.insert(block{5, 0}, 1)
+	v.set = append(v.set, block{1 << 16, 0})
+	var buf bytes.Buffer
+	v.WriteTo(&buf)
+
+	u := New(0)
+	if _, err := u.ReadFrom(&buf); err != nil {
+		t.Fatalf("Reading a set with empty blocks failed: %v", err)
+	}
+	u.set = slices.Grow(u.set, 100)
+	want := New(0).Set(1).Set(1000).Set(1 << 20)
+	if u.Equal(want) {
+		t.Fatalf("The set read should hold empty blocks")
+	}
+	if u.Optimize() != u || !u.Equal(want) || u.Valid() != nil {
+		t.Errorf("Optimize should remove empty blocks, leaving %v", u.set)
+	}
+	if cap(u.set) != len(u.set) {
+		t.Errorf("Optimize should shrink capacity to %d, but it is %d", len(u.set), cap(u.set))
+	}
+	if u.Cardinality() != 3 {
+		t.Errorf("Expected cardinality 3, got %d", u.Cardinality())
+	}
+}
+
+func TestGrow(t *testing.T) {
+	v := New(0).Set(1).Set(1000)
+	if v.Grow(64*100-1) != v || cap(v.set) < 100 {
+		t.Errorf("Grow should reserve 100 blocks, but capacity is %d", cap(v.set))
+	}
+	if !v.Equal(New(0).Set(1).Set(1000)) {
+		t.Errorf("Grow should not change membership")
+	}
+
+	p := &v.set[0]
+	for i := uint64(0); i < 64*100; i += 3 {
+		v.Set(i)
+	}
+	if &v.set[0] != p {
+		t.Errorf("Setting bits up to the grown index should not reallocate")
+	}
+
+	c := cap(v.set)
+	v.Grow(10)
+	if cap(v.set) != c {
+		t.Errorf("Grow should not shrink storage")
+	}
+
+	u := New(0).Set(5)
+	if u.Grow(math.MaxUint64) != u || uint64(cap(u.set)) > 2*maxHintBlocks {
+		t.Errorf("Grow should cap its reservation, but capacity is %d", cap(u.set))
+	}
+	if !u.Equal(New(0).Set(5)) {
+		t.Errorf("Grow should not change membership")
+	}
+}
+
+func TestStats(t *testing.T) {
+	if st := New(0).Stats(); st != (Stats{}) {
+		t.Errorf("An empty set should have zero stats, got %+v", st)
+	}
+
+	v := New(0).SetRange(0, 32)
+	if st := v.Stats(); st != (Stats{1, 32, 0.5, v.Len()}) {
+		t.Errorf("A half-full word should have a fill ratio of 0.5, got %+v", st)
+	}
+
+	v.SetRange(64, 128).Set(1 << 20)
+	v.invalidate()
+	want := Stats{Blocks: 3, Bits: 32 + 64 + 1, FillRatio: 97.0 / 192, Bytes: v.Len()}
+	if st := v.Stats(); st != want {
+		t.Errorf("Expected %+v, got %+v", want, st)
+	}
+	if v.cardOK != 0 {
+		t.Errorf("Stats should not modify the set")
+	}
+}
+
+// TestPrunedInvariant applies random chains of the public operations,
+// and asserts that each leaves a valid set -- in particular, one with
+// no empty blocks -- so that `Equal` may compare blocks directly.
+func TestPrunedInvariant(t *testing.T) {
+	const dom = 1 << 14
+	r := rand.New(rand.NewSource(15))
+	idx := func() uint64 { return uint64(r.Int63n(dom)) }
+	rng := func() (uint64, uint64) {
+		lo := idx()
+		return lo, lo + uint64(r.Int63n(300))
+	}
+	operand := func() *BitSet {
+		c := New(0)
+		lo, hi := rng()
+		c.SetRange(lo, hi)
+		for i := 0; i < 20; i++ {
+			c.Set(idx())
+		}
+		return c
+	}
+
+	ops := []struct {
+		name string
+		fn   func(*BitSet) *BitSet
+	}{
+		{"Set", func(b *BitSet) *BitSet { return b.Set(idx()) }},
+		{"Clear", func(b *BitSet) *BitSet { return b.Clear(idx()) }},
+		{"Flip", func(b *BitSet) *BitSet { return b.Flip(idx()) }},
+		{"SetMany", func(b *BitSet) *BitSet { return b.SetMany(idx(), idx(), idx()) }},
+		{"ClearMany", func(b *BitSet) *BitSet {
+			n, _ := b.Min()
+			return b.ClearMany(n, idx(), idx())
+		}},
+		{"FlipMany", func(b *BitSet) *BitSet { return b.FlipMany(idx(), idx(), idx()) }},
+		{"TestAndSet", func(b *BitSet) *BitSet { b.TestAndSet(idx()); return b }},
+		{"TestAndClear", func(b *BitSet) *BitSet {
+			n, _ := b.Max()
+			b.TestAndClear(n)
+			return b
+		}},
+		{"Pop", func(b *BitSet) *BitSet { b.Pop(); return b }},
+		{"SetRange", func(b *BitSet) *BitSet { return b.SetRange(rng()) }},
+		{"ClearRange", func(b *BitSet) *BitSet { return b.ClearRange(rng()) }},
+		{"FlipRange", func(b *BitSet) *BitSet { return b.FlipRange(rng()) }},
+		{"ClearFrom", func(b *BitSet) *BitSet { return b.ClearFrom(idx() + dom/2) }},
+		{"ApplyOps", func(b *BitSet) *BitSet {
+			lo, _ := rng()
+			return b.ApplyOps([]Op{{lo, false}, {lo + 1, true}, {lo + 64, false}})
+		}},
+		{"ApplyDelta", func(b *BitSet) *BitSet { return b.ApplyDelta(operand(), b.Clone()) }},
+		{"InPlaceUnion", func(b *BitSet) *BitSet { return b.InPlaceUnion(operand()) }},
+		{"InPlaceUnionRange", func(b *BitSet) *BitSet {
+			lo, hi := rng()
+			return b.InPlaceUnionRange(operand(), lo, hi)
+		}},
+		{"InPlaceIntersection", func(b *BitSet) *BitSet { return b.InPlaceIntersection(b.Union(operand())) }},
+		{"InPlaceDifference", func(b *BitSet) *BitSet { return b.InPlaceDifference(operand()) }},
+		{"InPlaceDifferenceRange", func(b *BitSet) *BitSet { return b.InPlaceDifferenceRange(rng()) }},
+		{"InPlaceSymmetricDifference", func(b *BitSet) *BitSet { return b.InPlaceSymmetricDifference(operand()) }},
+		{"XorAssignTracked", func(b *BitSet) *BitSet { b.XorAssignTracked(operand()); return b }},
+		{"ClearCongruent", func(b *BitSet) *BitSet { return b.ClearCongruent(uint64(2+r.Intn(5)), 0) }},
+		{"ShiftLeft", func(b *BitSet) *BitSet { return b.ShiftLeft(uint64(r.Intn(100))) }},
+		{"ShiftRight", func(b *BitSet) *BitSet { return b.ShiftRight(uint64(r.Intn(100))) }},
+		{"InPlaceComplementWithin", func(b *BitSet) *BitSet { return b.InPlaceComplementWithin(dom) }},
+		{"Union", func(b *BitSet) *BitSet { return b.Union(operand()) }},
+		{"Intersection", func(b *BitSet) *BitSet { return b.Intersection(b.Union(operand())) }},
+		{"Difference", func(b *BitSet) *BitSet { return b.Difference(operand()) }},
+		{"DifferenceRange", func(b *BitSet) *BitSet { return b.DifferenceRange(rng()) }},
+		{"DifferenceMany", func(b *BitSet) *BitSet { return b.DifferenceMany(operand(), operand()) }},
+		{"SymmetricDifference", func(b *BitSet) *BitSet { return b.SymmetricDifference(operand()) }},
+		{"Agreement", func(b *BitSet) *BitSet { return b.Agreement(operand(), dom) }},
+		{"Complement", func(b *BitSet) *BitSet { return b.Complement() }},
+		{"ComplementWithin", func(b *BitSet) *BitSet { return b.ComplementWithin(dom) }},
+		{"UnionMany", func(b *BitSet) *BitSet { return UnionMany(b, operand()) }},
+		{"IntersectionMany", func(b *BitSet) *BitSet { return IntersectionMany(b, b.Union(operand())) }},
+	}
+
+	for chain := 0; chain < 200; chain++ {
+		b := operand()
+		var trail []string
+		for step := 0; step < 40; step++ {
+			op := ops[r.Intn(len(ops))]
+			trail = append(trail, op.name)
+			if b = op.fn(b); b == nil {
+				t.Fatalf("%v answered nil", trail)
+			}
+			if err := b.Valid(); err != nil {
+				t.Fatalf("%v left an invalid set: %v", trail, err)
+			}
+			if c := b.Cardinality(); c != popcountSet(b.set) {
+				t.Fatalf("%v left a stale cardinality %d, not %d", trail, c, popcountSet(b.set))
+			}
+		}
+	}
+}
+
+func TestSetWord(t *testing.T) {
+	v := New(0).Set(1).Set(130)
+
+	// Create.
+	v.SetWord(5, 0xf0f0)
+	if v.GetWord(5) != 0xf0f0 || len(v.set) != 3 {
+		t.Errorf("SetWord should create a block, but set is %v", v.set)
+	}
+
+	// Overwrite.
+	v.SetWord(2, 1<<63|1)
+	if v.GetWord(2) != 1<<63|1 || v.Test(130) || !v.Test(128) || !v.Test(191) {
+		t.Errorf("SetWord should overwrite a block, but set is %v", v.set)
+	}
+
+	// Delete via zero, including of an absent block.
+	v.SetWord(5, 0).SetWord(9, 0)
+	if v.GetWord(5) != 0 || len(v.set) != 2 {
+		t.Errorf("SetWord(0) should delete the block, but set is %v", v.set)
+	}
+	if err := v.Valid(); err != nil {
+		t.Errorf("SetWord left an invalid set: %v", err)
+	}
+
+	// Offsets beyond the top word are rejected.
+	top := uint64(math.MaxUint64) >> 6
+	if _, err := v.SetWordE(top, 1<<63); err != nil || !v.Test(math.MaxUint64) {
+		t.Errorf("SetWordE should accept the top word, got %v", err)
+	}
+	v.SetWord(top, 0)
+	if c, err := v.SetWordE(top+1, 1); c != nil || err != ErrInvalidIndex || len(v.set) != 2 {
+		t.Errorf("SetWordE should reject an offset beyond the top word, got %v", err)
+	}
+	if v.SetWord(math.MaxUint64, 1) != nil {
+		t.Errorf("SetWord should answer nil for an offset beyond the top word")
+	}
+
+	// Membership matches individual `Set` calls.
+	r := rand.New(rand.NewSource(16))
+	u, w := New(0), New(0)
+	for k := 0; k < 200; k++ {
+		off, bits := uint64(r.Int63n(50)), r.Uint64()
+		if k%7 == 0 {
+			bits = 0
+		}
+		u.SetWord(off, bits)
+		w.ClearRange(off*64, off*64+64)
+		for j := uint64(0); j < 64; j++ {
+			if bits&(1<<j) != 0 {
+				w.Set(off*64 + j)
+			}
+		}
+		if !u.Equal(w) || u.Cardinality() != w.Cardinality() {
+			t.Fatalf("SetWord(%d, %#x) should match individual Set calls", off, bits)
+		}
+	}
+	if u.GetWord(1000) != 0 {
+		t.Errorf("GetWord of an absent block should be 0")
+	}
+}
+
+func TestKeepRange(t *testing.T) {
+	keep := func(v *BitSet, lo, hi uint64) *BitSet {
+		return v.Intersection(New(0).SetRange(lo, hi))
+	}
+	base := New(0).SetRange(10, 50).SetRange(100, 300).Set(1000).Set(5000)
+
+	for _, c := range []struct {
+		lo, hi uint64
+	}{
+		{20, 30},    // part of one block
+		{0, 64},     // exactly one block
+		{40, 1001},  // spanning several blocks
+		{129, 4999}, // a boundary word only partly kept
+		{0, 1 << 20},
+		{1001, 4999}, // disjoint from all set bits
+		{1 << 20, 1 << 21},
+		{7, 7},
+	} {
+		v := base.Clone()
+		want := keep(base, c.lo, c.hi)
+		if v.KeepRange(c.lo, c.hi) != v || !v.Equal(want) {
+			t.Errorf("KeepRange(%d, %d) should match intersection with the range", c.lo, c.hi)
+		}
+		if err := v.Valid(); err != nil {
+			t.Errorf("KeepRange(%d, %d) left an invalid set: %v", c.lo, c.hi, err)
+		}
+		if v.Cardinality() != want.Cardinality() {
+			t.Errorf("KeepRange(%d, %d): expected cardinality %d, got %d", c.lo, c.hi, want.Cardinality(), v.Cardinality())
+		}
+	}
+
+	if v := base.Clone().KeepRange(1001, 4999); !v.None() {
+		t.Errorf("KeepRange disjoint from all set bits should be empty")
+	}
+	if base.Clone().KeepRange(5, 4) != nil {
+		t.Errorf("KeepRange should answer nil if lo > hi")
+	}
+}
+
+// BENCHMARKS
+
+func BenchmarkSet(b *testing.B) {
+	b.StopTimer()
+	r := rand.New(rand.NewSource(0))
+	sz := 100000
+	s := New(uint64(sz))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set(uint64(r.Int31n(int32(sz))))
+	}
+}
+
+func BenchmarkGetTest(b *testing.B) {
+	b.StopTimer()
+	r := rand.New(rand.NewSource(0))
+	sz := 100000
+	s := New(uint64(sz))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		s.Test(uint64(r.Int31n(int32(sz))))
+	}
+}
+
+func BenchmarkSetExpand(b *testing.B) {
+	b.StopTimer()
+	sz := uint64(100000)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		var s BitSet
+		s.Set(sz)
+	}
+}
+
+// go test -bench=Count
+func BenchmarkCount(b *testing.B) {
+	b.StopTimer()
+	s := New(100000)
+	for i := 0; i < 100000; i += 100 {
+		s.Set(uint64(i))
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		s.Count()
+	}
+}
+
+// go test -bench=Iterate
+func BenchmarkIterate(b *testing.B) {
+	b.StopTimer()
+	s := New(10000)
+	for i := 0; i < 10000; i += 3 {
+		s.Set(uint64(i))
+	}
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint(0)
+		for i, e := s.NextSet(0); e; i, e = s.NextSet(i + 1) {
+			c++
+		}
+	}
+}
+
+// go test -bench=SparseIterate
+func BenchmarkSparseIterate(b *testing.B) {
+	b.StopTimer()
+	s := New(100000)
+	for i := 0; i < 100000; i += 30 {
+		s.Set(uint64(i))
+	}
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint(0)
+		for i, e := s.NextSet(0); e; i, e = s.NextSet(i + 1) {
+			c++
+		}
+	}
+}
+
+// go test -bench=SparseBits
+func BenchmarkSparseBits(b *testing.B) {
+	b.StopTimer()
+	s := New(100000)
+	for i := 0; i < 100000; i += 30 {
+		s.Set(uint64(i))
+	}
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint(0)
+		for range s.Bits() {
+			c++
+		}
+	}
+}
+
+// go test -bench=SparseIterator
+func BenchmarkSparseIterator(b *testing.B) {
+	b.StopTimer()
+	s := New(100000)
+	for i := 0; i < 100000; i += 30 {
+		s.Set(uint64(i))
+	}
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint(0)
+		it := s.Iterator()
+		for _, e := it.Next(); e; _, e = it.Next() {
+			c++
+		}
+	}
+}
+
+// go test -bench=ApplyOps
+func BenchmarkApplyOps(b *testing.B) {
+	b.StopTimer()
+	r := rand.New(rand.NewSource(0))
+	ops := make([]Op, 0, 10000)
+	idx := uint64(0)
+	for i := 0; i < 10000; i++ {
+		idx += uint64(r.Int63n(200))
+		ops = append(ops, Op{idx, r.Intn(4) != 0})
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(idx)
+		s.ApplyOps(ops)
+	}
+}
+
+// go test -bench=InsertMiddle
+func BenchmarkInsertMiddle(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		var a blockAry
+		for j := 0; j < 1000; j++ {
+			a, _ = a.insert(block{uint64(j), 1}, uint32(len(a)/2))
+		}
+	}
+}
+
+// go test -bench=IterateRuns
+func BenchmarkIterateRuns(b *testing.B) {
+	b.StopTimer()
+	s := New(1000000)
+	for k := uint64(0); k < 4; k++ {
+		for i := k * 250000; i < k*250000+200000; i++ {
+			s.Set(i)
+		}
+	}
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint64(0)
+		it := s.IteratorOverRuns()
+		for start, end, ok := it.Next(); ok; start, end, ok = it.Next() {
+			c += end - start
+		}
+	}
+}
+
+func benchmarkJaccardSets() (*BitSet, *BitSet) {
+	r := rand.New(rand.NewSource(0))
+	a := New(1000000)
+	b := New(1000000)
+	for i := 0; i < 20000; i++ {
+		a.Set(uint64(r.Int63n(1000000)))
+		b.Set(uint64(r.Int63n(1000000)))
+	}
+	return a, b
+}
+
+// go test -bench=Jaccard
+func BenchmarkJaccard(b *testing.B) {
+	b.StopTimer()
+	x, y := benchmarkJaccardSets()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		j, _ := x.Jaccard(y)
+		_ = j >= 0.5
+	}
+}
+
+// go test -bench=Jaccard
+func BenchmarkJaccardAtLeast(b *testing.B) {
+	b.StopTimer()
+	x, y := benchmarkJaccardSets()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		x.JaccardAtLeast(y, 0.5)
+	}
+}
+
+// go test -bench=InPlaceSymmetricDifference
+func BenchmarkInPlaceSymmetricDifference(b *testing.B) {
+	b.StopTimer()
+	x := New(0)
+	y := New(0)
+	for i := uint64(0); i < 20000; i++ {
+		x.Set((20000 + i) * wordSize)
+		y.Set(i * wordSize) // many low blocks
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		z := x.Clone()
+		z.InPlaceSymmetricDifference(y)
+	}
+}
+
+// findLinear is the linear scan that `find` replaced; it is retained
+// for comparison.
+func findLinear(a blockAry, off uint64) (int, bool) {
+	for j, el := range a {
+		if el.Offset >= off {
+			return j, el.Offset == off
+		}
+	}
+	return len(a), false
+}
+
+func benchmarkFindSet() blockAry {
+	a := make(blockAry, 100000)
+	for k := range a {
+		a[k] = block{uint64(k) * 2, 1}
+	}
+	return a
+}
+
+// go test -bench=Find
+func BenchmarkFindLinear(b *testing.B) {
+	b.StopTimer()
+	a := benchmarkFindSet()
+	r := rand.New(rand.NewSource(0))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		findLinear(a, uint64(r.Int63n(200000)))
+	}
+}
+
+// go test -bench=Find
+func BenchmarkFindBinary(b *testing.B) {
+	b.StopTimer()
+	a := benchmarkFindSet()
+	r := rand.New(rand.NewSource(0))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		a.find(uint64(r.Int63n(200000)))
+	}
+}
+
+func BenchmarkNewDenseFill(b *testing.B) {
+	const n = 1 << 20
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := New(n)
+		for j := uint64(0); j < n; j += 8 {
+			s.Set(j)
+		}
+	}
+}
+
+func benchmarkIndices() []uint64 {
+	r := rand.New(rand.NewSource(0))
+	idx := make([]uint64, 1000000)
+	for i := range idx {
+		idx[i] = uint64(r.Int63n(1 << 22))
+	}
+	return idx
+}
+
+// go test -bench=NewFromSlice
+func BenchmarkNewFromSlice(b *testing.B) {
+	idx := benchmarkIndices()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewFromSlice(idx)
+	}
+}
+
+// go test -bench=NewFromSlice
+func BenchmarkNewFromSliceNaive(b *testing.B) {
+	idx := benchmarkIndices()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(0)
+		for _, n := range idx {
+			s.Set(n)
+		}
+	}
+}
+
+// go test -bench=SetMany
+func BenchmarkSetMany(b *testing.B) {
+	idx := benchmarkIndices()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		New(0).SetMany(idx...)
+	}
+}
+
+// go test -bench=CountAfterSet
+func BenchmarkCountAfterSet(b *testing.B) {
+	s := New(0).SetRange(0, 1<<20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Flip(uint64(i) & (1<<20 - 1))
+		s.Count()
+	}
+}
+
+func benchmarkManySets() []*BitSet {
+	r := rand.New(rand.NewSource(0))
+	sets := make([]*BitSet, 50)
+	for k := range sets {
+		sets[k] = New(0).SetRange(0, 50000)
+		for i := 0; i < 2000; i++ {
+			sets[k].Set(uint64(r.Int63n(1 << 22)))
+		}
+	}
+	return sets
+}
+
+// go test -bench=UnionMany
+func BenchmarkUnionMany(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		UnionMany(sets...)
+	}
+}
+
+// go test -bench=UnionMany
+func BenchmarkUnionManyPairwise(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u := sets[0]
+		for _, s := range sets[1:] {
+			u = u.Union(s)
+		}
+	}
+}
+
+// go test -bench=IntersectionMany
+func BenchmarkIntersectionMany(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		IntersectionMany(sets...)
+	}
+}
+
+// go test -bench=IntersectionMany
+func BenchmarkIntersectionManyPairwise(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := sets[0]
+		for _, s := range sets[1:] {
+			x = x.Intersection(s)
+		}
+	}
+}
+
+func benchmarkSetPair() (*BitSet, *BitSet) {
+	r := rand.New(rand.NewSource(0))
+	b, c := New(0), New(0)
+	b.set = make(blockAry, 0, 50000)
+	c.set = make(blockAry, 0, 50000)
+	for off := uint64(0); off < 100000; off++ {
+		if r.Intn(2) == 0 {
+			b.set = append(b.set, block{off, r.Uint64() | 1})
+		} else {
+			c.set = append(c.set, block{off, r.Uint64() | 1})
+		}
+	}
+	return b, c
+}
+
+// go test -bench=SetAlgebra
+func BenchmarkSetAlgebra(b *testing.B) {
+	x, y := benchmarkSetPair()
+	ops := []struct {
+		name string
+		fn   func(*BitSet) *BitSet
+	}{
+		{"Union", x.Union},
+		{"Intersection", x.Intersection},
+		{"Difference", x.Difference},
+		{"SymmetricDifference", x.SymmetricDifference},
+	}
+	for _, op := range ops {
+		b.Run(op.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				op.fn(y)
+			}
+		})
+	}
+}
+
+// go test -bench=Clone
+func BenchmarkClone(b *testing.B) {
+	x, _ := benchmarkSetPair()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Clone()
+	}
+}
+
+// go test -bench=InPlaceUnion
+func BenchmarkInPlaceUnion(b *testing.B) {
+	x, y := benchmarkSetPair()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Clone().InPlaceUnion(y)
+	}
+}
+
+// go test -bench=SparseNextSetMany
+func BenchmarkSparseNextSetMany(b *testing.B) {
+	b.StopTimer()
+	s := New(100000)
+	for i := 0; i < 100000; i += 30 {
+		s.Set(uint64(i))
+	}
+	buf := make([]uint64, 256)
+	b.ReportAllocs()
+	b.StartTimer()
+	for j := 0; j < b.N; j++ {
+		c := uint(0)
+		for n, more := uint64(0), true; more; {
+			var part []uint64
+			n, part, more = s.NextSetMany(n, buf)
+			c += uint(len(part))
+		}
+	}
+}
+
+func benchmarkHugeSet() *BitSet {
+	r := rand.New(rand.NewSource(0))
+	v := New(0)
+	v.set = make(blockAry, 5000000)
+	for i := range v.set {
+		v.set[i] = block{uint64(i) * 2, r.Uint64() | 1}
+	}
+	return v
+}
+
+// go test -bench=CardinalitySerial
+func BenchmarkCardinalitySerial(b *testing.B) {
+	v := benchmarkHugeSet()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v.invalidate()
+		v.Cardinality()
+	}
+}
+
+// go test -bench=CardinalityParallel
+func BenchmarkCardinalityParallel(b *testing.B) {
+	v := benchmarkHugeSet()
+	shards := runtime.GOMAXPROCS(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v.invalidate()
+		v.CardinalityParallel(shards)
+	}
+}
+
+// go test -bench=Builder
+func BenchmarkBuilder(b *testing.B) {
+	idx := benchmarkIndices()
+	slices.Sort(idx)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var bl Builder
+		for _, n := range idx {
+			bl.Add(n)
+		}
+		bl.Build()
+	}
+}
+
+// go test -bench=SortedSet
+func BenchmarkSortedSet(b *testing.B) {
+	idx := benchmarkIndices()
+	slices.Sort(idx)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(0)
+		for _, n := range idx {
+			s.Set(n)
+		}
+	}
+}
+
+// go test -bench=DifferenceMany
+func BenchmarkDifferenceMany(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sets[0].DifferenceMany(sets[1:]...)
+	}
+}
+
+// go test -bench=DifferenceMany
+func BenchmarkDifferenceManyPairwise(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := sets[0]
+		for _, s := range sets[1:] {
+			x = x.Difference(s)
+		}
+	}
+}
+
+// go test -bench=Prune
+func BenchmarkPrune(b *testing.B) {
+	src := make(blockAry, 100000)
+	for i := range src {
+		src[i] = block{uint64(i), uint64(i % 2)}
+	}
+	v := New(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		v.set = append(v.set[:0], src...)
+		b.StartTimer()
+		v.prune()
+	}
+}
+
+// go test -bench=GrowDenseFill
+func BenchmarkGrowDenseFill(b *testing.B) {
+	const n = 1 << 20
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := New(0).Grow(n - 1)
+		b.StartTimer()
+		for j := uint64(0); j < n; j += 8 {
+			s.Set(j)
+		}
+	}
+}
+
+// go test -bench=CardinalityMany
+func BenchmarkIntersectionCardinalityMany(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sets[0].IntersectionCardinalityMany(sets[1:]...)
+	}
+}
+
+// go test -bench=CardinalityMany
+func BenchmarkUnionCardinalityMany(b *testing.B) {
+	sets := benchmarkManySets()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sets[0].UnionCardinalityMany(sets[1:]...)
 	}
 }
@@ -0,0 +1,64 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+// Builder constructs a bitset from indices given in ascending order.
+// Since each index is at or after the previous one, it is recorded in
+// the last block, or in a new block appended after it, without
+// searching.
+//
+// The zero value is an empty builder, ready for use.
+//
+// Example usage:
+//
+//	var bl Builder
+//	for _, n := range postings {
+//	    if err := bl.Add(n); err != nil {
+//	        ...
+//	    }
+//	}
+//	set := bl.Build()
+type Builder struct {
+	set  blockAry
+	last uint64
+}
+
+// Add records the given index.  It answers `ErrIndexOutOfOrder`,
+// leaving the builder unchanged, if the index is smaller than the one
+// last added.
+func (bl *Builder) Add(n uint64) error {
+	l := len(bl.set)
+	if l > 0 && n < bl.last {
+		return ErrIndexOutOfOrder
+	}
+
+	off, bit := offsetBits(n)
+	if l > 0 && bl.set[l-1].Offset == off {
+		bl.set[l-1].setBit(bit)
+	} else {
+		bl.set = append(bl.set, block{off, 1 << bit})
+	}
+	bl.last = n
+	return nil
+}
+
+// Build answers the bitset holding the indices added so far.  The
+// builder is reset, so that it can be reused without affecting the
+// answered bitset.
+func (bl *Builder) Build() *BitSet {
+	b := &BitSet{set: bl.set}
+	bl.set, bl.last = nil, 0
+	return b
+}
@@ -0,0 +1,146 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// WriteToCompressed serialises this bitset to the given `io.Writer`,
+// in a compact form suited to clustered bitsets.  Its format version
+// is followed by the number of runs, as a varint.  A run is a maximal
+// sequence of blocks with consecutive offsets and identical words.
+// Each run is written as the gap from the end of the previous run to
+// its first offset, and its length, both as varints, followed by its
+// word.  Hence, a long stretch of full words takes only a few bytes.
+// It should be de-serialised using `ReadFromCompressed`.
+func (b *BitSet) WriteToCompressed(w io.Writer) (int64, error) {
+	var body []byte
+	runs := uint64(0)
+	next := uint64(0)
+	lb := len(b.set)
+	for i := 0; i < lb; {
+		el := b.set[i]
+		j := i + 1
+		for j < lb && b.set[j].Offset == b.set[j-1].Offset+1 && b.set[j].Bits == el.Bits {
+			j++
+		}
+
+		body = binary.AppendUvarint(body, el.Offset-next)
+		body = binary.AppendUvarint(body, uint64(j-i))
+		body = binary.BigEndian.AppendUint64(body, el.Bits)
+		runs++
+		next = b.set[j-1].Offset + 1
+		i = j
+	}
+
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(body))
+	buf = append(buf, byte(FormatCompressed))
+	buf = binary.AppendUvarint(buf, runs)
+	buf = append(buf, body...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFromCompressed de-serialises the data written by
+// `WriteToCompressed` from the given `io.Reader` stream into this
+// bitset.  Since a few bytes of input can describe a very long run, it
+// answers `ErrInvalidLength` if the runs expand to more than 2^28
+// blocks in all, rather than allocate for them.  On error, this
+// bitset is left unchanged.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) ReadFromCompressed(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	c, err := cr.ReadByte()
+	if err != nil {
+		return cr.n, err
+	}
+	if Format(c) != FormatCompressed {
+		return cr.n, ErrUnknownFormat
+	}
+
+	runs, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return cr.n, err
+	}
+
+	maxOff := uint64(math.MaxUint64) >> log2WordSize
+	set := make(blockAry, 0, min(runs, maxHintBlocks))
+	next := uint64(0)
+	var word [8]byte
+	for k := uint64(0); k < runs; k++ {
+		gap, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return cr.n, err
+		}
+		l, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return cr.n, err
+		}
+		_, err = io.ReadFull(cr, word[:])
+		if err != nil {
+			return cr.n, err
+		}
+
+		w := binary.BigEndian.Uint64(word[:])
+		switch {
+		case l == 0 || l > maxExpandedBlocks-uint64(len(set)):
+			return cr.n, ErrInvalidLength
+		case w == 0:
+			return cr.n, ErrEmptyBlock
+		case next+gap < next || next+gap > maxOff || l-1 > maxOff-(next+gap):
+			return cr.n, ErrInvalidIndex
+		}
+
+		off := next + gap
+		for m := uint64(0); m < l; m++ {
+			set = append(set, block{off + m, w})
+		}
+		next = off + l
+	}
+
+	b.set = set
+	b.invalidate()
+	return cr.n, nil
+}
+
+// countingReader reads from the underlying reader, counting the
+// bytes read.  It implements `io.ByteReader` without reading ahead,
+// so that the underlying reader is not consumed beyond the data.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	buf [1]byte
+}
+
+// Read implements `io.Reader`.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadByte implements `io.ByteReader`.
+func (c *countingReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(c, c.buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return c.buf[0], nil
+}
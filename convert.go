@@ -0,0 +1,220 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"encoding/binary"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ToByteBitmap answers a dense bitmap of `ceil(lengthBits/8)` bytes,
+// in which bit `i` of this bitset is at bit `i%8` of byte `i/8`.  Bits
+// at or beyond `lengthBits` are dropped.
+func (b *BitSet) ToByteBitmap(lengthBits uint64) []byte {
+	n := lengthBits >> 3
+	if lengthBits&7 != 0 {
+		n++
+	}
+	buf := make([]byte, n)
+
+	var word [8]byte
+	for _, el := range b.set {
+		start := el.Offset << 3
+		if start >= n {
+			break
+		}
+
+		binary.LittleEndian.PutUint64(word[:], el.Bits)
+		copy(buf[start:], word[:])
+	}
+	if r := lengthBits & 7; r != 0 {
+		buf[n-1] &= byte(1)<<r - 1
+	}
+
+	return buf
+}
+
+// FromByteBitmap creates a new bitset from the given dense bitmap, in
+// which bit `i` is at bit `i%8` of byte `i/8`.
+func FromByteBitmap(buf []byte) *BitSet {
+	res := new(BitSet)
+
+	var word [8]byte
+	for off := 0; off < len(buf); off += 8 {
+		word = [8]byte{}
+		copy(word[:], buf[off:])
+
+		bits := binary.LittleEndian.Uint64(word[:])
+		if bits != 0 {
+			res.set = append(res.set, block{uint64(off >> 3), bits})
+		}
+	}
+
+	return res
+}
+
+// BigInt answers a non-negative integer, whose bit `i` is set if and
+// only if bit `i` of this bitset is set.
+//
+// N.B. The integer is dense: it needs about `Max()/8` bytes, and
+// twice that transiently, however sparse this bitset may be.
+func (b *BitSet) BigInt() *big.Int {
+	buf := b.Bytes()
+	slices.Reverse(buf)
+	return new(big.Int).SetBytes(buf)
+}
+
+// FromBigInt creates a new bitset, with bit `i` set if and only if
+// bit `i` of the given integer is set.  It answers `nil` if the
+// integer is `nil` or negative.
+func FromBigInt(x *big.Int) *BitSet {
+	if x == nil || x.Sign() < 0 {
+		return nil
+	}
+
+	buf := x.Bytes()
+	slices.Reverse(buf)
+	return FromByteBitmap(buf)
+}
+
+// Bytes answers a dense bitmap of this bitset, as `ToByteBitmap` does,
+// sized to hold its highest set bit.  Bit `i` is at bit `i%8` of byte
+// `i/8`.  An empty bitset answers an empty slice.
+func (b *BitSet) Bytes() []byte {
+	max, ok := b.Max()
+	if !ok {
+		return []byte{}
+	}
+	return b.ToByteBitmap(max + 1)
+}
+
+// FromBytes is an alias for `FromByteBitmap`.
+func FromBytes(buf []byte) *BitSet {
+	return FromByteBitmap(buf)
+}
+
+// ToSlice answers the indices of the bits set in this bitset, in
+// ascending order.  An empty bitset answers an empty, non-`nil` slice.
+func (b *BitSet) ToSlice() []uint64 {
+	res := make([]uint64, 0, popcountSet(b.set))
+	for _, el := range b.set {
+		base := el.Offset * wordSize
+		for w := el.Bits; w > 0; w &= w - 1 {
+			res = append(res, base+trailingZeroes64(w))
+		}
+	}
+	return res
+}
+
+// StringLimit caps the number of indices listed by `String`.
+var StringLimit = 1000
+
+// String answers a human-readable form of this bitset, listing the
+// indices of its set bits in ascending order, e.g. `{0,1,2,10}`.  At
+// most `StringLimit` indices are listed; should there be more, the
+// list ends in `...`.
+func (b *BitSet) String() string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	n := 0
+	for _, el := range b.set {
+		base := el.Offset * wordSize
+		for w := el.Bits; w > 0; w &= w - 1 {
+			if n > 0 {
+				sb.WriteByte(',')
+			}
+			if n >= StringLimit {
+				sb.WriteString("...}")
+				return sb.String()
+			}
+			sb.WriteString(strconv.FormatUint(base+trailingZeroes64(w), 10))
+			n++
+		}
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// ToMap answers a map whose keys are the indices of the bits set in
+// this bitset.
+func (b *BitSet) ToMap() map[uint64]struct{} {
+	m := make(map[uint64]struct{}, popcountSet(b.set))
+	for _, el := range b.set {
+		base := el.Offset * wordSize
+		for w := el.Bits; w > 0; w &= w - 1 {
+			m[base+trailingZeroes64(w)] = struct{}{}
+		}
+	}
+	return m
+}
+
+// FromMap creates a new bitset with the bits at the keys of the given
+// map set.
+func FromMap(m map[uint64]struct{}) *BitSet {
+	idx := make([]uint64, 0, len(m))
+	for k := range m {
+		idx = append(idx, k)
+	}
+	slices.Sort(idx)
+
+	set, _ := blocksFromSorted(idx)
+	return &BitSet{set: set}
+}
+
+// NewFromSlice creates a new bitset with the bits at the given indices
+// set.  The indices may be in any order, and may repeat.  The given
+// slice is not modified.
+func NewFromSlice(indices []uint64) *BitSet {
+	idx := make([]uint64, len(indices))
+	copy(idx, indices)
+	slices.Sort(idx)
+
+	set, _ := blocksFromSorted(idx)
+	return &BitSet{set: set}
+}
+
+// NewFromSortedSlice creates a new bitset with the bits at the given
+// indices set.  The indices must be in ascending order; they may
+// repeat.  It builds the bitset in a single pass, and answers `nil`
+// should an index be lower than the one before it.
+func NewFromSortedSlice(indices []uint64) *BitSet {
+	set, ok := blocksFromSorted(indices)
+	if !ok {
+		return nil
+	}
+	return &BitSet{set: set}
+}
+
+// blocksFromSorted builds the blocks for the given indices, which
+// must be in ascending order.  Duplicate indices are harmless.  It
+// answers `false` should an index be lower than the one before it.
+func blocksFromSorted(idx []uint64) (blockAry, bool) {
+	var set blockAry
+	for i, n := range idx {
+		if i > 0 && n < idx[i-1] {
+			return nil, false
+		}
+		off, bit := offsetBits(n)
+		if l := len(set); l > 0 && set[l-1].Offset == off {
+			set[l-1].setBit(bit)
+			continue
+		}
+		set = append(set, block{off, 1 << bit})
+	}
+	return set, true
+}
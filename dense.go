@@ -0,0 +1,58 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build densebitset
+
+package sparsebitset
+
+import (
+	"github.com/bits-and-blooms/bitset"
+)
+
+// FromDense creates a new bitset holding the bits set in the given
+// dense `bitset.BitSet`.  It answers `nil` if the given set is `nil`.
+//
+// N.B. This file is built only with the `densebitset` build tag, so
+// that the package otherwise has no external dependencies.
+func FromDense(d *bitset.BitSet) *BitSet {
+	if d == nil {
+		return nil
+	}
+
+	res := new(BitSet)
+	for off, w := range d.Words() {
+		if w != 0 {
+			res.set = append(res.set, block{uint64(off), w})
+		}
+	}
+	return res
+}
+
+// ToDense answers a dense `bitset.BitSet` holding the bits set in this
+// bitset.
+//
+// N.B. The dense set needs about `Max()/8` bytes, however sparse this
+// bitset may be.
+func (b *BitSet) ToDense() *bitset.BitSet {
+	lb := len(b.set)
+	if lb == 0 {
+		return bitset.New(0)
+	}
+
+	words := make([]uint64, b.set[lb-1].Offset+1)
+	for _, el := range b.set {
+		words[el.Offset] = el.Bits
+	}
+	return bitset.From(words)
+}
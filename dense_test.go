@@ -0,0 +1,62 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build densebitset
+
+package sparsebitset
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/bits-and-blooms/bitset"
+)
+
+func TestDense(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	d := bitset.New(0)
+	for _, i := range []uint{0, 63, 64, 100000} {
+		d.Set(i)
+	}
+	for i := 0; i < 1000; i++ {
+		d.Set(uint(r.Int63n(100000)))
+	}
+
+	v := FromDense(d)
+	if uint(v.Cardinality()) != d.Count() {
+		t.Errorf("FromDense should hold %d bits, but holds %d", d.Count(), v.Cardinality())
+	}
+	for i, ok := d.NextSet(0); ok; i, ok = d.NextSet(i + 1) {
+		if !v.Test(uint64(i)) {
+			t.Errorf("FromDense should set bit %d", i)
+		}
+	}
+
+	e := v.ToDense()
+	if e.Count() != d.Count() || e.IntersectionCardinality(d) != d.Count() {
+		t.Errorf("Round trip through ToDense should answer an equal dense set")
+	}
+	for _, i := range v.ToSlice() {
+		if !e.Test(uint(i)) {
+			t.Errorf("ToDense should set bit %d", i)
+		}
+	}
+
+	if FromDense(nil) != nil {
+		t.Errorf("FromDense(nil) should be nil")
+	}
+	if e := New(0).ToDense(); e.Count() != 0 || !FromDense(e).None() {
+		t.Errorf("An empty bitset should convert to an empty dense set")
+	}
+}
@@ -27,4 +27,40 @@ var (
 	// ErrNilArgument is answered when an unexpected `nil` is
 	// encountered as an argument.
 	ErrNilArgument = errors.New("nil input given")
+
+	// ErrBlocksOutOfOrder is answered when serialised blocks are not in
+	// ascending order of their offsets.
+	ErrBlocksOutOfOrder = errors.New("blocks not in ascending order")
+
+	// ErrEmptyBlock is answered when a bitset holds a block with no
+	// bits set.
+	ErrEmptyBlock = errors.New("empty block found")
+
+	// ErrUnknownFormat is answered when serialised data is not in the
+	// expected format.
+	ErrUnknownFormat = errors.New("unknown serialisation format")
+
+	// ErrBadMagic is answered when serialised data does not begin with
+	// the expected magic number.
+	ErrBadMagic = errors.New("bad magic number in serialised data")
+
+	// ErrUnsupportedVersion is answered when serialised data is of an
+	// unsupported format version.
+	ErrUnsupportedVersion = errors.New("unsupported serialisation format version")
+
+	// ErrChecksumMismatch is answered when serialised data does not
+	// match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrInvalidLength is answered when serialised data is shorter or
+	// longer than its length prefix says.
+	ErrInvalidLength = errors.New("serialised data has an invalid length")
+
+	// ErrUnsupportedType is answered when a value of an unsupported
+	// type is given.
+	ErrUnsupportedType = errors.New("unsupported type given")
+
+	// ErrIndexOutOfOrder is answered when an index smaller than the
+	// previous one is given where ascending order is required.
+	ErrIndexOutOfOrder = errors.New("index not in ascending order")
 )
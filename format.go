@@ -0,0 +1,137 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"bytes"
+	"io"
+)
+
+// Format identifies the serialisation format of a bitset.
+//
+// Every format, other than `FormatLegacy`, begins with a one-byte
+// version.  Versions are drawn from the range [0xf0, 0xff], which the
+// first byte of the length prefix of `FormatLegacy` reaches only for
+// bitsets of more than about 3.75GiB.  Such bitsets can not be
+// recognised by `DetectFormat`.
+type Format byte
+
+const (
+	// FormatLegacy is the format written by `WriteTo` before it
+	// gained a header.  It has no version byte.
+	FormatLegacy Format = 0
+
+	// FormatStandard is the format written by `WriteTo`.  It is the
+	// first byte of its magic number.
+	FormatStandard Format = 0xf0
+
+	// FormatReversed is the format written by `WriteToReverse`.
+	FormatReversed Format = 0xf1
+
+	// FormatChecked is the format written by `WriteToChecked`.
+	FormatChecked Format = 0xf2
+
+	// FormatCompressed is the format written by `WriteToCompressed`.
+	FormatCompressed Format = 0xf3
+
+	// FormatStreamed is the format written by `WriteBlocksTo` and
+	// `UnionReaders`.
+	FormatStreamed Format = 0xf4
+
+	// minFormatVersion is the lowest version byte.
+	minFormatVersion = FormatStandard
+)
+
+// formatOf answers the format of a serialised bitset, whose first byte
+// is given.
+func formatOf(c byte) (Format, error) {
+	f := Format(c)
+	if f < minFormatVersion {
+		return FormatLegacy, nil
+	}
+
+	switch f {
+	case FormatStandard, FormatReversed, FormatChecked, FormatCompressed, FormatStreamed:
+		return f, nil
+	}
+	return 0, ErrUnknownFormat
+}
+
+// DetectFormat answers the format of the serialised bitset at the
+// head of the given stream.  If the stream has a `Peek` method (as
+// `*bufio.Reader` does), its first byte is only peeked.  Otherwise,
+// it is consumed; use `ReadAuto` to both detect the format and read
+// the bitset.
+func DetectFormat(r io.Reader) (Format, error) {
+	var c [1]byte
+	if p, ok := r.(interface {
+		Peek(int) ([]byte, error)
+	}); ok {
+		buf, err := p.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		c[0] = buf[0]
+	} else {
+		_, err := io.ReadFull(r, c[:])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return formatOf(c[0])
+}
+
+// ReadAuto detects the format of the serialised bitset at the head of
+// the given stream, and de-serialises it using the matching reader.
+// It answers `ErrUnknownFormat` for an unrecognised version.
+func ReadAuto(r io.Reader) (*BitSet, error) {
+	var c [1]byte
+	_, err := io.ReadFull(r, c[:])
+	if err != nil {
+		return nil, err
+	}
+	f, err := formatOf(c[0])
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(BitSet)
+	r = io.MultiReader(bytes.NewReader(c[:]), r)
+	switch f {
+	case FormatReversed:
+		_, err = b.ReadFromReverse(r)
+
+	case FormatChecked:
+		_, err = b.ReadFromChecked(r)
+
+	case FormatCompressed:
+		_, err = b.ReadFromCompressed(r)
+
+	case FormatStreamed:
+		_, err = b.ReadBlocksFrom(r)
+
+	case FormatStandard:
+		_, err = b.ReadFrom(r)
+
+	default:
+		_, err = b.readBody(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
@@ -0,0 +1,8 @@
+module github.com/js-ojus/sparsebitset
+
+go 1.23
+
+require (
+	github.com/bits-and-blooms/bitset v1.25.0
+	golang.org/x/tools v0.33.0
+)
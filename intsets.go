@@ -0,0 +1,60 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build intsets
+
+package sparsebitset
+
+import (
+	"math"
+
+	"golang.org/x/tools/container/intsets"
+)
+
+// FromIntsetsSparse creates a new bitset holding the elements of the
+// given `intsets.Sparse`.  Since a bitset can not hold negative
+// numbers, negative elements are skipped.  It answers `nil` if the
+// given set is `nil`.
+//
+// N.B. This file is built only with the `intsets` build tag, so that
+// the package otherwise has no external dependencies.
+func FromIntsetsSparse(s *intsets.Sparse) *BitSet {
+	if s == nil {
+		return nil
+	}
+
+	elems := s.AppendTo(nil)
+	idx := make([]uint64, 0, len(elems))
+	for _, x := range elems {
+		if x >= 0 {
+			idx = append(idx, uint64(x))
+		}
+	}
+	return NewFromSortedSlice(idx)
+}
+
+// ToIntsetsSparse answers an `intsets.Sparse` holding the indices of
+// the bits set in this bitset.  Since an `intsets.Sparse` holds `int`
+// elements, indices greater than `math.MaxInt` are skipped.
+func (b *BitSet) ToIntsetsSparse() *intsets.Sparse {
+	s := new(intsets.Sparse)
+	b.ForEach(func(n uint64) bool {
+		if n > math.MaxInt {
+			return false
+		}
+		s.Insert(int(n))
+		return true
+	})
+	return s
+}
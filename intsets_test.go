@@ -0,0 +1,52 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build intsets
+
+package sparsebitset
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/tools/container/intsets"
+)
+
+func TestIntsetsSparse(t *testing.T) {
+	var s intsets.Sparse
+	for _, x := range []int{0, 1, 63, 64, 1000, 1 << 40, -1, -1000} {
+		s.Insert(x)
+	}
+
+	v := FromIntsetsSparse(&s)
+	if !v.Equal(New(0).SetMany(0, 1, 63, 64, 1000, 1<<40)) {
+		t.Errorf("FromIntsetsSparse should copy the non-negative elements, got %v", v)
+	}
+
+	u := v.Clone().Set(math.MaxUint64).ToIntsetsSparse()
+	var exp intsets.Sparse
+	for _, x := range []int{0, 1, 63, 64, 1000, 1 << 40} {
+		exp.Insert(x)
+	}
+	if !u.Equals(&exp) {
+		t.Errorf("ToIntsetsSparse should be %v, but is %v", &exp, u)
+	}
+
+	if FromIntsetsSparse(nil) != nil {
+		t.Errorf("FromIntsetsSparse(nil) should be nil")
+	}
+	if !New(0).ToIntsetsSparse().IsEmpty() {
+		t.Errorf("ToIntsetsSparse of an empty bitset should be empty")
+	}
+}
@@ -0,0 +1,217 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+	"strconv"
+)
+
+// TextEncoding is the base64 encoding used by `MarshalText` and
+// `UnmarshalText`.  Set it to `base64.RawStdEncoding` to omit
+// padding.
+var TextEncoding = base64.StdEncoding
+
+// MarshalBinary implements `encoding.BinaryMarshaler`.  It answers
+// this bitset in the format of `WriteToChecked`.
+func (b *BitSet) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(1 + b.bodySize() + binary.Size(uint32(0)))
+	_, err := b.WriteToChecked(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements `encoding.BinaryUnmarshaler`.  It
+// answers `ErrInvalidLength` if the given data is truncated or has
+// trailing bytes, and `ErrChecksumMismatch` if it is corrupt.  On
+// error, this bitset is left unchanged.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) UnmarshalBinary(data []byte) error {
+	lsz := binary.Size(uint32(0))
+	if len(data) == 0 {
+		return ErrInvalidLength
+	}
+	if Format(data[0]) != FormatChecked {
+		return ErrUnknownFormat
+	}
+	if len(data) < 1+2*lsz {
+		return ErrInvalidLength
+	}
+	lb := binary.BigEndian.Uint32(data[1:])
+	if lb%uint32(2*binary.Size(uint64(0))) != 0 || uint64(lb) != uint64(len(data)-1-2*lsz) {
+		return ErrInvalidLength
+	}
+
+	_, err := b.ReadFromChecked(bytes.NewReader(data))
+	return err
+}
+
+// GobEncode implements `gob.GobEncoder`, using the format of
+// `MarshalBinary`.
+func (b *BitSet) GobEncode() ([]byte, error) {
+	return b.MarshalBinary()
+}
+
+// GobDecode implements `gob.GobDecoder`, using the format of
+// `MarshalBinary`.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) GobDecode(data []byte) error {
+	return b.UnmarshalBinary(data)
+}
+
+// Value implements `driver.Valuer`, answering the output of
+// `MarshalBinary`.  This suits binary columns, such as `bytea` in
+// PostgreSQL.  A `nil` bitset answers SQL `NULL`.
+func (b *BitSet) Value() (driver.Value, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return b.MarshalBinary()
+}
+
+// Scan implements `sql.Scanner`.  It accepts the output of `Value`, as
+// a `[]byte` or a `string`.  SQL `NULL` results in an empty bitset.
+// Any other type is rejected with `ErrUnsupportedType`.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		b.ClearAll()
+		return nil
+
+	case []byte:
+		return b.UnmarshalBinary(v)
+
+	case string:
+		return b.UnmarshalBinary([]byte(v))
+
+	default:
+		return ErrUnsupportedType
+	}
+}
+
+// MarshalText implements `encoding.TextMarshaler`.  It answers the
+// output of `MarshalBinary`, encoded using `TextEncoding`.
+func (b *BitSet) MarshalText() ([]byte, error) {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, TextEncoding.EncodedLen(len(data)))
+	TextEncoding.Encode(buf, data)
+	return buf, nil
+}
+
+// UnmarshalText implements `encoding.TextUnmarshaler`.  It decodes
+// the given text using `TextEncoding`, and then proceeds as
+// `UnmarshalBinary` does.  On error, this bitset is left unchanged.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) UnmarshalText(text []byte) error {
+	data := make([]byte, TextEncoding.DecodedLen(len(text)))
+	n, err := TextEncoding.Decode(data, text)
+	if err != nil {
+		return err
+	}
+	return b.UnmarshalBinary(data[:n])
+}
+
+// MarshalJSON implements `json.Marshaler`.  It answers the indices of
+// the bits set in this bitset as a JSON array of integers, in
+// ascending order, e.g. `[0,1,2,10]`.  For large bitsets, consider
+// `CompactBitSet` instead.
+func (b *BitSet) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 2+8*popcountSet(b.set))
+	buf = append(buf, '[')
+	for _, el := range b.set {
+		base := el.Offset * wordSize
+		for w := el.Bits; w > 0; w &= w - 1 {
+			if len(buf) > 1 {
+				buf = append(buf, ',')
+			}
+			buf = strconv.AppendUint(buf, base+trailingZeroes64(w), 10)
+		}
+	}
+	return append(buf, ']'), nil
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.  It accepts either a
+// JSON array of non-negative integers, in any order and possibly with
+// duplicates, or a JSON string in the form of `MarshalText`, as
+// answered by `CompactBitSet`.  As is the convention, JSON `null` is
+// a no-op.  On error, this bitset is left unchanged.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		return b.UnmarshalText([]byte(text))
+	}
+
+	var elems []json.RawMessage
+	err := json.Unmarshal(data, &elems)
+	if err != nil {
+		return err
+	}
+	idx := make([]uint64, len(elems))
+	for i, el := range elems {
+		idx[i], err = strconv.ParseUint(string(el), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	slices.Sort(idx)
+
+	b.set, _ = blocksFromSorted(idx)
+	b.invalidate()
+	return nil
+}
+
+// CompactBitSet is a `BitSet` that is marshalled to JSON as a string,
+// in the compact form of `MarshalText`, rather than as an array of
+// indices.  Convert a `*BitSet` to a `*CompactBitSet` to select this
+// form.
+type CompactBitSet BitSet
+
+// MarshalJSON implements `json.Marshaler`.
+func (c *CompactBitSet) MarshalJSON() ([]byte, error) {
+	text, err := (*BitSet)(c).MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.  It accepts the same
+// forms as `(*BitSet).UnmarshalJSON`.
+func (c *CompactBitSet) UnmarshalJSON(data []byte) error {
+	return (*BitSet)(c).UnmarshalJSON(data)
+}
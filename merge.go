@@ -0,0 +1,430 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// blockReader reads the blocks of a bitset serialised by `WriteTo`,
+// `WriteBlocksTo` or `UnionReaders`, one at a time.
+type blockReader struct {
+	r    io.Reader
+	n    uint64 // number of blocks yet to be read
+	open bool   // are the blocks terminated by an empty block?
+	head block  // most recently read block
+	read bool   // has at least one block been read?
+	buf  [16]byte
+}
+
+// newBlockReader reads the header and the length, or the block count,
+// from the given stream, and answers a reader positioned at the first
+// block.
+func newBlockReader(r io.Reader) (*blockReader, error) {
+	var c [1]byte
+	_, err := io.ReadFull(r, c[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if Format(c[0]) == FormatStreamed {
+		var count uint64
+		err = binary.Read(r, binary.BigEndian, &count)
+		if err != nil {
+			return nil, err
+		}
+		if count == openBlockCount {
+			return &blockReader{r: r, open: true}, nil
+		}
+		return &blockReader{r: r, n: count}, nil
+	}
+
+	_, err = readHeader(io.MultiReader(bytes.NewReader(c[:]), r))
+	if err != nil {
+		return nil, err
+	}
+
+	var lb uint32
+	err = binary.Read(r, binary.BigEndian, &lb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockReader{r: r, n: uint64(lb) / uint64(2*binary.Size(uint64(0)))}, nil
+}
+
+// advance reads the next block into `head`.  It answers `false` when
+// the stream has no more blocks.
+func (br *blockReader) advance() (bool, error) {
+	if !br.open && br.n == 0 {
+		return false, nil
+	}
+
+	_, err := io.ReadFull(br.r, br.buf[:])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, err
+	}
+
+	off := binary.BigEndian.Uint64(br.buf[:8])
+	bits := binary.BigEndian.Uint64(br.buf[8:])
+	if br.open {
+		if bits == 0 {
+			br.open = false
+			return false, nil
+		}
+	} else {
+		br.n--
+	}
+	if br.read && off <= br.head.Offset {
+		return false, ErrBlocksOutOfOrder
+	}
+	br.head = block{off, bits}
+	br.read = true
+	return true, nil
+}
+
+// blockHeap is a min-heap of block readers, ordered by the offsets of
+// their current blocks.
+type blockHeap []*blockReader
+
+func (h blockHeap) Len() int            { return len(h) }
+func (h blockHeap) Less(i, j int) bool  { return h[i].head.Offset < h[j].head.Offset }
+func (h blockHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *blockHeap) Push(x interface{}) { *h = append(*h, x.(*blockReader)) }
+func (h *blockHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// UnionReaders reads the bitsets serialised (by `WriteTo`,
+// `WriteBlocksTo`, or `UnionReaders` itself) in the given streams, and
+// writes their union to the given `io.Writer`.  The streams are merged
+// block by block, so only one block per stream is held in memory at
+// any time.
+//
+// Since the number of blocks in the union is not known until the
+// merge ends, the union is written in `FormatStreamed`, with a block
+// count of `math.MaxUint64`, and its blocks are terminated by an empty
+// block.  It should be de-serialised using `ReadBlocksFrom` or
+// `ReadAuto`.
+//
+// Each stream must have its blocks in ascending order of offsets;
+// `ErrBlocksOutOfOrder` is answered otherwise.
+func UnionReaders(w io.Writer, readers ...io.Reader) error {
+	h := make(blockHeap, 0, len(readers))
+	for _, r := range readers {
+		br, err := newBlockReader(r)
+		if err != nil {
+			return err
+		}
+		ok, err := br.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, br)
+		}
+	}
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+	var buf [16]byte
+	buf[0] = byte(FormatStreamed)
+	binary.BigEndian.PutUint64(buf[1:9], openBlockCount)
+	_, err := bw.Write(buf[:9])
+	if err != nil {
+		return err
+	}
+
+	for len(h) > 0 {
+		cur := block{Offset: h[0].head.Offset}
+		for len(h) > 0 && h[0].head.Offset == cur.Offset {
+			cur.Bits |= h[0].head.Bits
+
+			ok, err := h[0].advance()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+
+		if cur.Bits != 0 {
+			binary.BigEndian.PutUint64(buf[:8], cur.Offset)
+			binary.BigEndian.PutUint64(buf[8:], cur.Bits)
+			_, err = bw.Write(buf[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Terminate the blocks with an empty one.
+	clear(buf[:])
+	_, err = bw.Write(buf[:])
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// setCursor is a position in the blocks of a bitset.
+type setCursor struct {
+	set blockAry
+	i   int
+}
+
+// seek advances this cursor to the first block at or beyond the given
+// offset.  It answers `false` if there is no such block.  Since the
+// target is often near, a few blocks are stepped over before resorting
+// to a binary search.
+func (c *setCursor) seek(off uint64) bool {
+	for n := 0; c.i < len(c.set) && c.set[c.i].Offset < off; n++ {
+		if n == 4 {
+			j, _ := c.set[c.i:].find(off)
+			c.i += j
+			break
+		}
+		c.i++
+	}
+	return c.i < len(c.set)
+}
+
+// cursorHeap is a min-heap of set cursors, ordered by the offsets of
+// their current blocks.
+type cursorHeap []setCursor
+
+func (h cursorHeap) Len() int            { return len(h) }
+func (h cursorHeap) Less(i, j int) bool  { return h[i].set[h[i].i].Offset < h[j].set[h[j].i].Offset }
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(setCursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// UnionMany answers the union of the given bitsets, computed in a
+// single k-way merge of their blocks.  Only the result is allocated.
+// `nil` bitsets are treated as empty; with no bitsets, it answers an
+// empty bitset.
+func UnionMany(sets ...*BitSet) *BitSet {
+	n := 0
+	for _, b := range sets {
+		if b != nil && len(b.set) > n {
+			n = len(b.set)
+		}
+	}
+
+	res := &BitSet{set: make(blockAry, 0, n)}
+	unionBlocks(sets, func(el block) {
+		res.appendBlock(el)
+	})
+	res.cardOK = 1
+	return res
+}
+
+// unionBlocks merges the blocks of the given bitsets, in a k-way merge,
+// and invokes the given function for each block of their union, in
+// ascending order of offset.  `nil` bitsets are skipped.
+func unionBlocks(sets []*BitSet, fn func(block)) {
+	h := make(cursorHeap, 0, len(sets))
+	for _, b := range sets {
+		if b != nil && len(b.set) > 0 {
+			h = append(h, setCursor{b.set, 0})
+		}
+	}
+	heap.Init(&h)
+
+	var cur block
+	started := false
+	for len(h) > 0 {
+		el := h[0].set[h[0].i]
+		switch {
+		case started && cur.Offset == el.Offset:
+			cur.Bits |= el.Bits
+		case started:
+			fn(cur)
+			cur = el
+		default:
+			cur, started = el, true
+		}
+
+		h[0].i++
+		if h[0].i < len(h[0].set) {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	if started {
+		fn(cur)
+	}
+}
+
+// IntersectionMany answers the intersection of the given bitsets,
+// computed in a single pass over their blocks.  The blocks of the
+// smallest bitset are the candidates; the others skip ahead to each,
+// by binary search, and a candidate is dropped as soon as it shares
+// no bits with them.  Only the result is allocated.  `nil` bitsets
+// are treated as empty; with no bitsets, it answers an empty bitset.
+func IntersectionMany(sets ...*BitSet) *BitSet {
+	res := new(BitSet)
+	intersectBlocks(sets, func(el block) {
+		res.appendBlock(el)
+	})
+	res.cardOK = 1
+	return res
+}
+
+// intersectBlocks invokes the given function for each block of the
+// intersection of the given bitsets, in ascending order of offset, as
+// described for `IntersectionMany`.  `nil` bitsets are treated as
+// empty.
+func intersectBlocks(sets []*BitSet, fn func(block)) {
+	if len(sets) == 0 {
+		return
+	}
+	cs := make([]setCursor, len(sets))
+	for k, b := range sets {
+		if b == nil || len(b.set) == 0 {
+			return
+		}
+		cs[k] = setCursor{b.set, 0}
+	}
+	sort.Slice(cs, func(i, j int) bool { return len(cs[i].set) < len(cs[j].set) })
+
+	lead := &cs[0]
+	for lead.i < len(lead.set) {
+		cur := lead.set[lead.i]
+		w := cur.Bits
+		next := cur.Offset + 1
+		for k := 1; k < len(cs) && w != 0; k++ {
+			if !cs[k].seek(cur.Offset) {
+				return
+			}
+			bl := cs[k].set[cs[k].i]
+			if bl.Offset != cur.Offset {
+				w, next = 0, bl.Offset
+				break
+			}
+			w &= bl.Bits
+		}
+
+		if w != 0 {
+			fn(block{cur.Offset, w})
+		}
+		if !lead.seek(next) {
+			break
+		}
+	}
+}
+
+// UnionCardinalityMany answers the cardinality of the union of this
+// bitset with all of the given bitsets.  It is computed in a single
+// k-way merge, as in `UnionMany`, without constructing an
+// intermediate bitset.  It answers `ErrNilArgument` if any of the
+// given bitsets is `nil`.
+func (b *BitSet) UnionCardinalityMany(cs ...*BitSet) (uint64, error) {
+	sets, err := withBase(b, cs)
+	if err != nil {
+		return 0, err
+	}
+
+	var c uint64
+	unionBlocks(sets, func(el block) {
+		c += popcount(el.Bits)
+	})
+	return c, nil
+}
+
+// IntersectionCardinalityMany answers the cardinality of the
+// intersection of this bitset with all of the given bitsets.  It is
+// computed in a single pass, as in `IntersectionMany`, without
+// constructing an intermediate bitset.  It answers `ErrNilArgument`
+// if any of the given bitsets is `nil`.
+func (b *BitSet) IntersectionCardinalityMany(cs ...*BitSet) (uint64, error) {
+	sets, err := withBase(b, cs)
+	if err != nil {
+		return 0, err
+	}
+
+	var c uint64
+	intersectBlocks(sets, func(el block) {
+		c += popcount(el.Bits)
+	})
+	return c, nil
+}
+
+// withBase answers the given base bitset followed by the others.  It
+// answers `ErrNilArgument` if any of the others is `nil`.
+func withBase(b *BitSet, cs []*BitSet) ([]*BitSet, error) {
+	sets := make([]*BitSet, 0, 1+len(cs))
+	sets = append(sets, b)
+	for _, c := range cs {
+		if c == nil {
+			return nil, ErrNilArgument
+		}
+		sets = append(sets, c)
+	}
+	return sets, nil
+}
+
+// DifferenceMany answers the difference of the given bitsets from
+// this bitset, i.e. the bits of this bitset that are set in none of
+// them.  It is computed in a single pass over the blocks of this
+// bitset, the others skipping ahead to each as in `IntersectionMany`.
+// Only the result is allocated.  `nil` bitsets are skipped.
+func (b *BitSet) DifferenceMany(cs ...*BitSet) *BitSet {
+	subs := make([]setCursor, 0, len(cs))
+	for _, c := range cs {
+		if c != nil && len(c.set) > 0 {
+			subs = append(subs, setCursor{c.set, 0})
+		}
+	}
+
+	res := &BitSet{set: make(blockAry, 0, len(b.set))}
+	for _, el := range b.set {
+		w := el.Bits
+		for k := 0; k < len(subs) && w != 0; k++ {
+			c := &subs[k]
+			if c.seek(el.Offset) && c.set[c.i].Offset == el.Offset {
+				w &^= c.set[c.i].Bits
+			}
+		}
+		if w != 0 {
+			res.appendBlock(block{el.Offset, w})
+		}
+	}
+
+	res.cardOK = 1
+	return res
+}
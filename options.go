@@ -0,0 +1,64 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import "math"
+
+// options holds the settings that `NewWith` uses to size a new
+// bitset.
+type options struct {
+	bits    uint64
+	density float64
+}
+
+// Option configures a bitset created by `NewWith`.
+type Option func(*options)
+
+// WithCapacityHint gives the expected upper bound of the indices that
+// will be set in the new bitset.
+func WithCapacityHint(bits uint64) Option {
+	return func(o *options) {
+		o.bits = bits
+	}
+}
+
+// WithDensity gives the expected fraction of words, up to the capacity
+// hint, that will have at least one bit set.  Values outside (0, 1]
+// are ignored.
+func WithDensity(f float64) Option {
+	return func(o *options) {
+		if f > 0 && f <= 1 {
+			o.density = f
+		}
+	}
+}
+
+// NewWith creates a new BitSet, reserving capacity according to the
+// given options.  Without options, it behaves as `New(0)`.  As with
+// `New`, never more than `maxHintBlocks` blocks are reserved up front.
+//
+// Example usage:
+//
+//	b := NewWith(WithCapacityHint(1 << 20), WithDensity(0.25))
+func NewWith(opts ...Option) *BitSet {
+	o := options{density: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	nb := uint64(math.Ceil(float64(o.bits>>log2WordSize+1) * o.density))
+	nb = max(1, min(nb, maxHintBlocks))
+	return &BitSet{set: make(blockAry, 0, nb)}
+}
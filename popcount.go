@@ -14,17 +14,13 @@
 
 package sparsebitset
 
-// popcount answers the number of bits set to `1` in this word.  It
-// uses the bit population count (Hamming Weight) logic taken from
-// https://code.google.com/p/go/issues/detail?id=4988#c11.  Original
-// by 'https://code.google.com/u/arnehormann/'.
-func popcount(x uint64) (n uint64) {
-	x -= (x >> 1) & 0x5555555555555555
-	x = (x>>2)&0x3333333333333333 + x&0x3333333333333333
-	x += x >> 4
-	x &= 0x0f0f0f0f0f0f0f0f
-	x *= 0x0101010101010101
-	return x >> 56
+import "math/bits"
+
+// popcount answers the number of bits set to `1` in this word.  The
+// compiler lowers `bits.OnesCount64` to a single instruction, where
+// the hardware supports it.
+func popcount(x uint64) uint64 {
+	return uint64(bits.OnesCount64(x))
 }
 
 // popcountSet answers the number of bits set to `1` in this set.
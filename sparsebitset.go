@@ -28,8 +28,16 @@ package sparsebitset
 
 import (
 	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
-	"log"
+	"iter"
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -47,23 +55,50 @@ const (
 
 	// Density of bits, expressed as a fraction of the total space.
 	bitDensity = 0.1
-)
 
-var deBruijn = [...]byte{
-	0, 1, 56, 2, 57, 49, 28, 3, 61, 58, 42, 50, 38, 29, 17, 4,
-	62, 47, 59, 36, 45, 43, 51, 22, 53, 39, 33, 30, 24, 18, 12, 5,
-	63, 55, 48, 27, 60, 41, 37, 16, 46, 35, 44, 21, 52, 32, 23, 11,
-	54, 26, 40, 15, 34, 20, 31, 10, 25, 14, 19, 9, 13, 8, 7, 6,
-}
+	// maxHintBlocks caps the capacity that `New` reserves, so that a
+	// generous size hint does not allocate the whole range up front.
+	maxHintBlocks = uint64(1 << 16)
+
+	// maxExpandedBlocks caps the number of blocks that
+	// `ReadFromCompressed` expands its runs into.  It matches the most
+	// that `WriteTo` can serialise.
+	maxExpandedBlocks = uint64(1 << 28)
+
+	// minShardBlocks is the fewest blocks for which a separate
+	// goroutine pays off in `CardinalityParallel`.
+	minShardBlocks = 1 << 14
+)
 
+// trailingZeroes64 answers the number of trailing `0` bits in the
+// given word.  Callers only pass non-zero words.  Should a `0` slip
+// through, it answers `0` (rather than `64`), as did the deBruijn
+// table lookup that this replaced.
 func trailingZeroes64(v uint64) uint64 {
-	return uint64(deBruijn[((v&-v)*0x03f79d71b4ca8b09)>>58])
+	if v == 0 {
+		return 0
+	}
+	return uint64(bits.TrailingZeros64(v))
 }
 
 func offsetBits(n uint64) (uint64, uint64) {
 	return n >> log2WordSize, n & modWordSize
 }
 
+// rangeMask answers a mask of those bits of the word at the given
+// offset that lie in the range [lo, hi).  The word must overlap the
+// range.
+func rangeMask(off, lo, hi uint64) uint64 {
+	m := allOnes
+	if loOff, loBit := offsetBits(lo); off == loOff {
+		m &= allOnes << loBit
+	}
+	if hiOff, hiBit := offsetBits(hi - 1); off == hiOff {
+		m &= allOnes >> (modWordSize - hiBit)
+	}
+	return m
+}
+
 // block is a pair of (offset, mask).
 type block struct {
 	Offset uint64
@@ -110,22 +145,18 @@ func (a blockAry) Swap(i, j int) {
 	a[i], a[j] = a[j], a[i]
 }
 
-// insert inserts the given block at the specified location.
+// insert inserts the given block at the specified location.  The
+// backing array grows through `append`, i.e. geometrically, so that
+// repeated insertions do not reallocate each time.
 func (a blockAry) insert(b block, idx uint32) (blockAry, error) {
-	l := len(a)
-	if int(idx) >= l {
-		a = append(a, b)
-		return a, nil
-	}
-
-	t := make([]block, 0, l+1)
-	if idx > 0 {
-		t = append(t, a[:idx]...)
+	if int(idx) >= len(a) {
+		return append(a, b), nil
 	}
-	t = append(t, b)
-	t = append(t, a[idx:]...)
 
-	return t, nil
+	a = append(a, block{})
+	copy(a[idx+1:], a[idx:])
+	a[idx] = b
+	return a, nil
 }
 
 // delete removes the block at the specified location.
@@ -141,24 +172,30 @@ func (a blockAry) delete(idx uint32) (blockAry, error) {
 	return a, nil
 }
 
+// find answers the index of the block with the given offset, and
+// `true`, if there is such a block.  Otherwise, it answers the index
+// at which such a block should be inserted, and `false`.
+func (a blockAry) find(off uint64) (int, bool) {
+	lo, hi := 0, len(a)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if a[m].Offset < off {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo, lo < len(a) && a[lo].Offset == off
+}
+
 // setBit sets the bit at the given position to `1`.
 func (a blockAry) setBit(n uint64) (blockAry, error) {
 	off, bit := offsetBits(n)
 
-	i := -1
-	for j, el := range a {
-		if el.Offset > off {
-			i = j
-			break
-		}
-		if el.Offset == off {
-			el.setBit(bit)
-			a[j] = el
-			return a, nil
-		}
-	}
-	if i == -1 { // all blocks (if any) have smaller offsets
-		i = len(a)
+	i, found := a.find(off)
+	if found {
+		a[i].setBit(bit)
+		return a, nil
 	}
 
 	return a.insert(block{off, 1 << bit}, uint32(i))
@@ -168,14 +205,8 @@ func (a blockAry) setBit(n uint64) (blockAry, error) {
 func (a blockAry) clearBit(n uint64) (blockAry, error) {
 	off, bit := offsetBits(n)
 
-	i := -1
-	for j, el := range a {
-		if el.Offset == off {
-			i = j
-			break
-		}
-	}
-	if i == -1 { // nothing to do
+	i, found := a.find(off)
+	if !found { // nothing to do
 		return a, nil
 	}
 
@@ -190,38 +221,25 @@ func (a blockAry) clearBit(n uint64) (blockAry, error) {
 func (a blockAry) flipBit(n uint64) (blockAry, error) {
 	off, bit := offsetBits(n)
 
-	i := -1
-	for j, el := range a {
-		if el.Offset == off {
-			i = j
-			break
-		}
-	}
-	if i == -1 {
-		return a, ErrItemNotFound
+	i, found := a.find(off)
+	if !found {
+		return a.insert(block{off, 1 << bit}, uint32(i))
 	}
 
 	a[i].flipBit(bit)
+	if a[i].Bits == 0 {
+		return a.delete(uint32(i))
+	}
 	return a, nil
 }
 
 // testBit answers `true` if the bit at the given position is set;
 // `false` otherwise.
 func (a blockAry) testBit(n uint64) bool {
-	if n == 0 {
-		return false
-	}
-
 	off, bit := offsetBits(n)
 
-	i := -1
-	for j, el := range a {
-		if el.Offset == off {
-			i = j
-			break
-		}
-	}
-	if i == -1 {
+	i, found := a.find(off)
+	if !found {
 		return false
 	}
 
@@ -231,17 +249,56 @@ func (a blockAry) testBit(n uint64) bool {
 // BitSet is a compact representation of sparse positive integer sets.
 type BitSet struct {
 	set blockAry
+
+	// card caches the cardinality of this bitset.  It is valid only
+	// if `cardOK` is `1`.  Methods that only read this bitset access
+	// both atomically, using `cached` and `cache`, so that concurrent
+	// readers may fill the cache without racing.
+	card   uint64
+	cardOK uint32
+}
+
+// invalidate marks the cached cardinality of this bitset as stale.
+// Methods that modify the blocks of this bitset, without maintaining
+// the cache, must call it.
+func (b *BitSet) invalidate() {
+	b.cardOK = 0
 }
 
-// New creates a new BitSet using the given size hint.
+// cached answers the cached cardinality of this bitset, and whether it
+// is valid.
+func (b *BitSet) cached() (uint64, bool) {
+	if atomic.LoadUint32(&b.cardOK) == 0 {
+		return 0, false
+	}
+	return atomic.LoadUint64(&b.card), true
+}
+
+// cache stores the given cardinality of this bitset, and marks it
+// valid.  Concurrent readers store the same value, so they may call it
+// together.
+func (b *BitSet) cache(c uint64) {
+	atomic.StoreUint64(&b.card, c)
+	atomic.StoreUint32(&b.cardOK, 1)
+}
+
+// appendBlock appends the given block to this bitset, adding its bits
+// to the cached cardinality.  Constructors that build a bitset block by
+// block use it, and mark the cache valid when done.
+func (b *BitSet) appendBlock(el block) {
+	b.set = append(b.set, el)
+	b.card += popcount(el.Bits)
+}
+
+// New creates a new BitSet using the given size hint.  The hint is
+// the expected upper bound of the indices that will be set; enough
+// capacity is reserved for one block per word up to it, but never
+// more than `maxHintBlocks` blocks.
 //
-// `BitSet` is **not** thread-safe!
+// `BitSet` is **not** thread-safe!  Concurrent reads are safe, but no
+// read may be concurrent with a modification.
 func New(n uint64) *BitSet {
-	// dens := bitDensity * float64(n)
-	// if dens < 1.0 {
-	// 	dens = 1.0
-	// }
-	return &BitSet{make(blockAry, 0, 1)}
+	return NewWith(WithCapacityHint(n))
 }
 
 // Len answers the number of bytes used by this bitset.
@@ -249,6 +306,40 @@ func (b *BitSet) Len() int {
 	return len(b.set) * binary.Size(uint64(0))
 }
 
+// Stats describes the memory efficiency of a bitset.  It is answered
+// by `Stats`.
+type Stats struct {
+	// Blocks is the number of blocks.
+	Blocks int
+
+	// Bits is the number of bits set.
+	Bits uint64
+
+	// FillRatio is the fraction of the bits in the blocks that are
+	// set, in [0, 1].  It is `0` for an empty bitset.
+	FillRatio float64
+
+	// Bytes is the estimated size of the bitset, as answered by `Len`.
+	Bytes int
+}
+
+// Stats answers the memory efficiency of this bitset.  A low fill
+// ratio suits this sparse representation; one near `1` suggests that
+// a dense bitset would be more compact.  It does not modify this
+// bitset.
+func (b *BitSet) Stats() Stats {
+	st := Stats{Blocks: len(b.set), Bytes: b.Len()}
+	c, ok := b.cached()
+	if !ok {
+		c = popcountSet(b.set)
+	}
+	st.Bits = c
+	if st.Blocks > 0 {
+		st.FillRatio = float64(st.Bits) / float64(uint64(st.Blocks)*wordSize)
+	}
+	return st
+}
+
 // Test answers `true` if the bit at the given position is set;
 // `false` otherwise.
 func (b *BitSet) Test(n uint64) bool {
@@ -256,27 +347,102 @@ func (b *BitSet) Test(n uint64) bool {
 }
 
 // Set sets the bit at the given position to `1`.
+//
+// N.B. Should the underlying operation fail, `Set` answers `nil`, and
+// a chained call on that result panics.  Use `SetE` to receive the
+// error instead.
 func (b *BitSet) Set(n uint64) *BitSet {
+	c, _ := b.SetE(n)
+	return c
+}
+
+// SetE sets the bit at the given position to `1`.  It answers this
+// bitset, or `nil` and the error should the operation fail.
+func (b *BitSet) SetE(n uint64) (*BitSet, error) {
+	was := b.set.testBit(n)
 	ary, err := b.set.setBit(n)
 	if err != nil {
-		log.Println(err, ":", n)
-		return nil
+		return nil, err
 	}
 
 	b.set = ary
-	return b
+	if !was {
+		b.card++
+	}
+	return b, nil
 }
 
 // Clear sets the bit at the given position to `0`.
+//
+// N.B. Should the underlying operation fail, `Clear` answers `nil`,
+// and a chained call on that result panics.  Use `ClearE` to receive
+// the error instead.
 func (b *BitSet) Clear(n uint64) *BitSet {
+	c, _ := b.ClearE(n)
+	return c
+}
+
+// ClearE sets the bit at the given position to `0`.  It answers this
+// bitset, or `nil` and the error should the operation fail.
+func (b *BitSet) ClearE(n uint64) (*BitSet, error) {
+	was := b.set.testBit(n)
 	ary, err := b.set.clearBit(n)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
 
 	b.set = ary
-	return b
+	if was {
+		b.card--
+	}
+	return b, nil
+}
+
+// SetWord replaces the 64 bits at the given word offset -- i.e. the
+// bits at indices [offset*64, offset*64+64) -- with the given word.
+// Setting a word to `0` removes its block.
+//
+// N.B. Should the offset be beyond that of the word holding the bit at
+// `math.MaxUint64`, `SetWord` answers `nil`, and a chained call on
+// that result panics.  Use `SetWordE` to receive the error instead.
+func (b *BitSet) SetWord(offset, bits uint64) *BitSet {
+	c, _ := b.SetWordE(offset, bits)
+	return c
+}
+
+// SetWordE replaces the 64 bits at the given word offset, as described
+// for `SetWord`.  It answers this bitset, or `nil` and
+// `ErrInvalidIndex` should the offset be out of range.
+func (b *BitSet) SetWordE(offset, bits uint64) (*BitSet, error) {
+	if offset > uint64(math.MaxUint64)>>log2WordSize {
+		return nil, ErrInvalidIndex
+	}
+
+	i, found := b.set.find(offset)
+	switch {
+	case found && bits == 0:
+		b.card -= popcount(b.set[i].Bits)
+		b.set, _ = b.set.delete(uint32(i))
+
+	case found:
+		b.card += popcount(bits) - popcount(b.set[i].Bits)
+		b.set[i].Bits = bits
+
+	case bits != 0:
+		b.card += popcount(bits)
+		b.set, _ = b.set.insert(block{offset, bits}, uint32(i))
+	}
+	return b, nil
+}
+
+// GetWord answers the 64 bits at the given word offset, as described
+// for `SetWord`.  It answers `0` if there is no such block.
+func (b *BitSet) GetWord(offset uint64) uint64 {
+	i, found := b.set.find(offset)
+	if !found {
+		return 0
+	}
+	return b.set[i].Bits
 }
 
 // SetTo sets the bit at the given position to the given value.
@@ -287,215 +453,1485 @@ func (b *BitSet) SetTo(n uint64, val bool) *BitSet {
 	return b.Clear(n)
 }
 
+// Add is an alias for `Set`.
+func (b *BitSet) Add(n uint64) *BitSet {
+	return b.Set(n)
+}
+
+// Remove is an alias for `Clear`.
+func (b *BitSet) Remove(n uint64) *BitSet {
+	return b.Clear(n)
+}
+
+// Contains is an alias for `Test`.
+func (b *BitSet) Contains(n uint64) bool {
+	return b.Test(n)
+}
+
 // Flip inverts the bit at the given position.
+//
+// N.B. Should the underlying operation fail, `Flip` answers `nil`,
+// and a chained call on that result panics.  Use `FlipE` to receive
+// the error instead.
 func (b *BitSet) Flip(n uint64) *BitSet {
+	c, _ := b.FlipE(n)
+	return c
+}
+
+// FlipE inverts the bit at the given position.  It answers this
+// bitset, or `nil` and the error should the operation fail.
+func (b *BitSet) FlipE(n uint64) (*BitSet, error) {
 	ary, err := b.set.flipBit(n)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
 
 	b.set = ary
-	return b
+	if b.set.testBit(n) {
+		b.card++
+	} else {
+		b.card--
+	}
+	return b, nil
 }
 
-// NextSet answers the next bit that is set, starting with (and
-// including) the given index.  The boolean part of the output tuple
-// indicates the presence (`true`) or absence (`false`) of such a bit
-// in this bitset.
-//
-// Example usage:
-//   for idx, ok := set.NextSet(0); ok; idx, ok = set.NextSet(idx+1) {
-//       ...
-//   }
-func (b *BitSet) NextSet(n uint64) (uint64, bool) {
-	off, rsh := offsetBits(n)
+// TestAndSet sets the bit at the given position to `1`, and answers
+// its prior value.
+func (b *BitSet) TestAndSet(n uint64) bool {
+	off, bit := offsetBits(n)
 
-	i := -1
-	for j, el := range b.set {
-		if el.Offset == off {
-			w := el.Bits >> rsh
-			if w > 0 {
-				return n + trailingZeroes64(w), true
-			}
-		}
-		if el.Offset > off {
-			i = j
-			break
-		}
-	}
-	if i == -1 {
-		return 0, false
+	i, found := b.set.find(off)
+	if found && b.set[i].testBit(bit) {
+		return true
 	}
 
-	return (b.set[i].Offset * wordSize) + trailingZeroes64(b.set[i].Bits), true
+	if found {
+		b.set[i].setBit(bit)
+	} else {
+		b.set, _ = b.set.insert(block{off, 1 << bit}, uint32(i))
+	}
+	b.card++
+	return false
 }
 
-// ClearAll resets this bitset.
-func (b *BitSet) ClearAll() *BitSet {
-	b.set = b.set[:0]
-	return b
-}
+// TestAndClear sets the bit at the given position to `0`, and answers
+// its prior value.
+func (b *BitSet) TestAndClear(n uint64) bool {
+	off, bit := offsetBits(n)
 
-// Clone answers a copy of this bitset.
-func (b *BitSet) Clone() *BitSet {
-	var c BitSet
-	c.set = make(blockAry, 0, len(b.set))
-	for _, el := range b.set {
-		c.set = append(c.set, el)
+	i, found := b.set.find(off)
+	if !found || !b.set[i].testBit(bit) {
+		return false
 	}
-	return &c
+
+	b.set[i].clearBit(bit)
+	if b.set[i].Bits == 0 {
+		b.set, _ = b.set.delete(uint32(i))
+	}
+	b.card--
+	return true
 }
 
-// Copy copies this bitset into the destination bitset.  It answers
-// the size of the destination bitset.
-func (b *BitSet) Copy(c *BitSet) int {
-	if c == nil {
-		return 0
+// Pop clears the lowest bit that is set in this bitset, and answers
+// its index.  The boolean part of the output tuple is `false` if this
+// bitset is empty.
+func (b *BitSet) Pop() (uint64, bool) {
+	if len(b.set) == 0 {
+		return 0, false
 	}
 
-	ctr := 0
-	for _, el := range b.set {
-		c.set = append(c.set, el)
-		ctr++
+	el := &b.set[0]
+	bit := trailingZeroes64(el.Bits)
+	n := el.Offset*wordSize + bit
+	el.clearBit(bit)
+	if el.Bits == 0 {
+		b.set, _ = b.set.delete(0)
 	}
-	return ctr * 2 * binary.Size(uint64(0))
+	b.card--
+	return n, true
 }
 
-// Count is an alias for `Cardinality`.
-func (b *BitSet) Count() uint64 {
-	return b.Cardinality()
+// SetMany sets the bits at the given positions to `1`.  The
+// positions may be in any order, and may repeat; they are sorted, so
+// that the blocks of this bitset are walked only once.
+func (b *BitSet) SetMany(ns ...uint64) *BitSet {
+	return b.applySorted(ns, func(w, m uint64) uint64 { return w | m })
 }
 
-// Cardinality answers the number of bits in this bitset that are set
-// to `1`.
-func (b *BitSet) Cardinality() uint64 {
-	return popcountSet(b.set)
+// ClearMany sets the bits at the given positions to `0`.  The
+// positions may be in any order, and may repeat.
+func (b *BitSet) ClearMany(ns ...uint64) *BitSet {
+	return b.applySorted(ns, func(w, m uint64) uint64 { return w &^ m })
 }
 
-// Equal answers `true` iff the two sets have the same bits set to
-// `1`.
-func (b *BitSet) Equal(c *BitSet) bool {
-	if c == nil {
-		return false
-	}
-	lb := len(b.set)
-	if lb != len(c.set) {
-		return false
-	}
-	if lb == 0 { // both are empty
-		return true
-	}
+// FlipMany inverts the bits at the given positions.  The positions
+// may be in any order.
+//
+// N.B. Each distinct position is inverted once, no matter how many
+// times it is given.
+func (b *BitSet) FlipMany(ns ...uint64) *BitSet {
+	return b.applySorted(ns, func(w, m uint64) uint64 { return w ^ m })
+}
 
-	for i, el := range b.set {
-		cel := c.set[i]
-		if el.Offset != cel.Offset || el.Bits != cel.Bits {
-			return false
+// applySorted replaces each word that holds any of the given
+// positions with the result of `fn`, given the word (`0` if it is
+// missing) and the mask of the positions in it.  Words that become
+// `0` are dropped.  The given slice is not modified.
+func (b *BitSet) applySorted(ns []uint64, fn func(w, m uint64) uint64) *BitSet {
+	idx := make([]uint64, len(ns))
+	copy(idx, ns)
+	slices.Sort(idx)
+
+	res := make(blockAry, 0, len(b.set)+len(idx))
+	lb, ln := len(b.set), len(idx)
+	i, k := 0, 0
+	for k < ln {
+		off, _ := offsetBits(idx[k])
+		for i < lb && b.set[i].Offset < off {
+			res = append(res, b.set[i])
+			i++
 		}
-	}
-	return true
-}
 
-// prune removes empty blocks from this bitset.
-func (b *BitSet) prune() {
-	chg := true
-	resume := 0
-
-	for chg {
-		chg = false
-		i := -1
-		for j := resume; j < len(b.set); j++ {
-			if b.set[j].Bits == 0 {
-				i = j
+		var w, m uint64
+		if i < lb && b.set[i].Offset == off {
+			w = b.set[i].Bits
+			i++
+		}
+		for ; k < ln; k++ {
+			o, bit := offsetBits(idx[k])
+			if o != off {
 				break
 			}
+			m |= 1 << bit
 		}
-		if i > -1 {
-			b.set, _ = b.set.delete(uint32(i))
-			chg = true
-			resume = i
+		if w = fn(w, m); w != 0 {
+			res = append(res, block{off, w})
 		}
 	}
+	res = append(res, b.set[i:]...)
+
+	b.set = res
+	b.invalidate()
+	return b
 }
 
-// Difference performs a 'set minus' of the given bitset from this
-// bitset.
-func (b *BitSet) Difference(c *BitSet) *BitSet {
-	if c == nil {
-		return nil
+// ContainsRange answers `true` if all the bits in the range [lo, hi)
+// are set.  It stops at the first missing block, or clear bit.  An
+// empty range is contained; it answers `false` if `lo > hi`.
+func (b *BitSet) ContainsRange(lo, hi uint64) bool {
+	if lo >= hi {
+		return lo == hi
 	}
 
-	res := new(BitSet)
-	lb := len(b.set)
-	lc := len(c.set)
-	i, j := 0, 0
-	for i < lb && j < lc {
-		bbl, cbl := b.set[i], c.set[j]
-
-		switch {
-		case bbl.Offset < cbl.Offset:
-			res.set = append(res.set, bbl)
-			i++
+	loOff, _ := offsetBits(lo)
+	hiOff, _ := offsetBits(hi - 1)
+	i, _ := b.set.find(loOff)
+	for off := loOff; off <= hiOff; off, i = off+1, i+1 {
+		if i >= len(b.set) || b.set[i].Offset != off {
+			return false
+		}
+		if m := rangeMask(off, lo, hi); b.set[i].Bits&m != m {
+			return false
+		}
+	}
+	return true
+}
 
-		case bbl.Offset == cbl.Offset:
-			var t block
-			t.Offset = bbl.Offset
-			t.Bits = bbl.Bits &^ cbl.Bits
-			res.set = append(res.set, t)
-			i, j = i+1, j+1
+// AnyInRange answers `true` if any bit in the range [lo, hi) is set.
+// It stops at the first such bit.  It answers `false` for an empty
+// range, and if `lo > hi`.
+func (b *BitSet) AnyInRange(lo, hi uint64) bool {
+	if lo >= hi {
+		return false
+	}
 
-		default:
-			j++
+	loOff, _ := offsetBits(lo)
+	hiOff, _ := offsetBits(hi - 1)
+	i, _ := b.set.find(loOff)
+	for ; i < len(b.set) && b.set[i].Offset <= hiOff; i++ {
+		if b.set[i].Bits&rangeMask(b.set[i].Offset, lo, hi) != 0 {
+			return true
 		}
 	}
-	for ; i < lb; i++ {
-		res.set = append(res.set, b.set[i])
-	}
+	return false
+}
 
-	res.prune()
-	return res
+// SetRange sets all the bits in the range [lo, hi) to `1`.  Missing
+// blocks are created directly, rather than one bit at a time.  It
+// answers `nil` if `lo > hi`.
+func (b *BitSet) SetRange(lo, hi uint64) *BitSet {
+	return b.applyRange(lo, hi, func(w, m uint64) uint64 { return w | m })
 }
 
-// InPlaceDifference performs a 'set minus' of the given bitset from
-// this bitset, updating this bitset itself.
-func (b *BitSet) InPlaceDifference(c *BitSet) *BitSet {
-	if c == nil {
+// ClearRange sets all the bits in the range [lo, hi) to `0`.  It
+// answers `nil` if `lo > hi`.
+func (b *BitSet) ClearRange(lo, hi uint64) *BitSet {
+	return b.InPlaceDifferenceRange(lo, hi)
+}
+
+// KeepRange sets all the bits outside the range [lo, hi) to `0`,
+// updating this bitset itself.  It is the intersection of this bitset
+// with the range, without constructing the range as a bitset.  It
+// answers `nil` if `lo > hi`.
+func (b *BitSet) KeepRange(lo, hi uint64) *BitSet {
+	if lo > hi {
 		return nil
 	}
+	if lo == hi {
+		return b.ClearAll()
+	}
 
-	lb := len(b.set)
-	lc := len(c.set)
-	i, j := 0, 0
-	for i < lb && j < lc {
-		bbl, cbl := b.set[i], c.set[j]
+	loOff, _ := offsetBits(lo)
+	hiOff, _ := offsetBits(hi - 1)
+	i, _ := b.set.find(loOff)
+	j, found := b.set.find(hiOff)
+	if found {
+		j++
+	}
 
-		switch {
-		case bbl.Offset < cbl.Offset:
-			i++
+	b.set = b.set[:copy(b.set, b.set[i:j])]
+	if l := len(b.set); l > 0 {
+		b.set[0].Bits &= rangeMask(b.set[0].Offset, lo, hi)
+		b.set[l-1].Bits &= rangeMask(b.set[l-1].Offset, lo, hi)
+		b.prune()
+	}
+	b.invalidate()
+	return b
+}
 
-		case bbl.Offset == cbl.Offset:
-			bbl.Bits &^= cbl.Bits
-			b.set[i] = bbl
-			i, j = i+1, j+1
+// ClearFrom sets all the bits at indices greater than or equal to the
+// given index to `0`, updating this bitset itself.
+func (b *BitSet) ClearFrom(n uint64) *BitSet {
+	off, bit := offsetBits(n)
 
-		default:
-			j++
+	i, found := b.set.find(off)
+	if found {
+		b.set[i].Bits &= 1<<bit - 1
+		if b.set[i].Bits != 0 {
+			i++
 		}
 	}
 
-	b.prune()
+	b.set = b.set[:i]
+	b.invalidate()
 	return b
 }
 
-// DifferenceCardinality answers the cardinality of the difference set
-// between this bitset and the given bitset.  This does *not*
-// construct an intermediate bitset.
-func (b *BitSet) DifferenceCardinality(c *BitSet) (uint64, error) {
-	if c == nil {
-		return 0, ErrNilArgument
-	}
+// Truncate is an alias for `ClearFrom`.
+func (b *BitSet) Truncate(n uint64) *BitSet {
+	return b.ClearFrom(n)
+}
 
-	return popcountSetAndNot(b.set, c.set), nil
+// FlipRange inverts all the bits in the range [lo, hi).  Blocks are
+// created for words in the range that have none, and removed for
+// words that become `0`.  It answers `nil` if `lo > hi`.
+func (b *BitSet) FlipRange(lo, hi uint64) *BitSet {
+	return b.applyRange(lo, hi, func(w, m uint64) uint64 { return w ^ m })
+}
+
+// applyRange replaces each word that overlaps the range [lo, hi) with
+// the result of `fn`, given the word (`0` if it is missing) and the
+// mask of its bits that lie in the range.  Words that become `0` are
+// dropped.  This bitset is rebuilt in a single pass.
+func (b *BitSet) applyRange(lo, hi uint64, fn func(w, m uint64) uint64) *BitSet {
+	if lo > hi {
+		return nil
+	}
+	if lo == hi {
+		return b
+	}
+
+	loOff, _ := offsetBits(lo)
+	hiOff, _ := offsetBits(hi - 1)
+	i, _ := b.set.find(loOff)
+	j, found := b.set.find(hiOff)
+	if found {
+		j++
+	}
+
+	res := make(blockAry, 0, i+int(hiOff-loOff+1)+len(b.set)-j)
+	res = append(res, b.set[:i]...)
+	for off := loOff; off <= hiOff; off++ {
+		var w uint64
+		if i < j && b.set[i].Offset == off {
+			w = b.set[i].Bits
+			i++
+		}
+		if w = fn(w, rangeMask(off, lo, hi)); w != 0 {
+			res = append(res, block{off, w})
+		}
+	}
+	res = append(res, b.set[j:]...)
+
+	b.set = res
+	b.invalidate()
+	return b
+}
+
+// Op is a single bit operation, as applied by `ApplyOps`.  The bit at
+// `Index` is set to `1` if `Value` is `true`, and to `0` otherwise.
+type Op struct {
+	Index uint64
+	Value bool
+}
+
+// ApplyOps applies the given operations to this bitset, walking its
+// blocks only once.  `ops` must be sorted by index; when several
+// operations refer to the same index, the last one wins.  It answers
+// `nil` if `ops` is not sorted.
+func (b *BitSet) ApplyOps(ops []Op) *BitSet {
+	lo := len(ops)
+	for k := 1; k < lo; k++ {
+		if ops[k].Index < ops[k-1].Index {
+			return nil
+		}
+	}
+
+	res := make(blockAry, 0, len(b.set))
+	lb := len(b.set)
+	i, k := 0, 0
+	for k < lo {
+		off, _ := offsetBits(ops[k].Index)
+		for i < lb && b.set[i].Offset < off {
+			res = append(res, b.set[i])
+			i++
+		}
+
+		t := block{Offset: off}
+		if i < lb && b.set[i].Offset == off {
+			t.Bits = b.set[i].Bits
+			i++
+		}
+		for ; k < lo; k++ {
+			o, bit := offsetBits(ops[k].Index)
+			if o != off {
+				break
+			}
+			if ops[k].Value {
+				t.setBit(bit)
+			} else {
+				t.clearBit(bit)
+			}
+		}
+		res = append(res, t)
+	}
+	res = append(res, b.set[i:]...)
+
+	b.set = res
+	b.prune()
+	b.invalidate()
+	return b
+}
+
+// ApplyDelta updates this bitset by adding the bits of `added` and
+// removing those of `removed`, in a single merge.  A bit present in
+// both `added` and `removed` is removed.  A `nil` argument is treated
+// as an empty bitset.
+func (b *BitSet) ApplyDelta(added, removed *BitSet) *BitSet {
+	var aset, rset blockAry
+	if added != nil {
+		aset = added.set
+	}
+	if removed != nil {
+		rset = removed.set
+	}
+
+	res := make(blockAry, 0, len(b.set)+len(aset))
+	lb := len(b.set)
+	la := len(aset)
+	lr := len(rset)
+	i, j, k := 0, 0, 0
+	for i < lb || j < la {
+		var t block
+		switch {
+		case j == la || (i < lb && b.set[i].Offset < aset[j].Offset):
+			t = b.set[i]
+			i++
+
+		case i == lb || b.set[i].Offset > aset[j].Offset:
+			t = aset[j]
+			j++
+
+		default:
+			t = block{b.set[i].Offset, b.set[i].Bits | aset[j].Bits}
+			i, j = i+1, j+1
+		}
+
+		for k < lr && rset[k].Offset < t.Offset {
+			k++
+		}
+		if k < lr && rset[k].Offset == t.Offset {
+			t.Bits &^= rset[k].Bits
+		}
+		if t.Bits != 0 {
+			res = append(res, t)
+		}
+	}
+
+	b.set = res
+	b.invalidate()
+	return b
+}
+
+// NextSet answers the next bit that is set, starting with (and
+// including) the given index.  The boolean part of the output tuple
+// indicates the presence (`true`) or absence (`false`) of such a bit
+// in this bitset.
+//
+// Example usage:
+//   for idx, ok := set.NextSet(0); ok; idx, ok = set.NextSet(idx+1) {
+//       ...
+//   }
+func (b *BitSet) NextSet(n uint64) (uint64, bool) {
+	off, rsh := offsetBits(n)
+
+	i, found := b.set.find(off)
+	if found {
+		w := b.set[i].Bits >> rsh
+		if w > 0 {
+			return n + trailingZeroes64(w), true
+		}
+		i++
+	}
+	if i >= len(b.set) {
+		return 0, false
+	}
+
+	return (b.set[i].Offset * wordSize) + trailingZeroes64(b.set[i].Bits), true
+}
+
+// NextSetMany fills the given buffer with up to `len(buf)` indices that
+// are set in this bitset, starting at the given index.  It answers the
+// index from which to resume, the filled part of the buffer, and
+// whether any set bits remain beyond those answered.  The buffer is
+// resliced, never grown, so that no allocation takes place.  Since no
+// progress can be made with an empty buffer, it answers `false` then.
+//
+// N.B. Should the bit at `math.MaxUint64` be set, the resume index
+// wraps around to `0`; the boolean part is then `false`, so iteration
+// should stop on it, rather than on an empty answer.
+//
+// Example usage:
+//   buf := make([]uint64, 256)
+//   for n, more := uint64(0), true; more; {
+//       var got []uint64
+//       n, got, more = set.NextSetMany(n, buf)
+//       ...
+//   }
+func (b *BitSet) NextSetMany(n uint64, buf []uint64) (uint64, []uint64, bool) {
+	res := buf[:0]
+	if len(buf) == 0 {
+		return n, res, false
+	}
+
+	off, rsh := offsetBits(n)
+	i, found := b.set.find(off)
+	var w, base uint64
+	if found {
+		w, base = b.set[i].Bits>>rsh<<rsh, off*wordSize
+		i++
+	}
+	for len(res) < len(buf) {
+		if w == 0 {
+			if i == len(b.set) {
+				break
+			}
+			w, base = b.set[i].Bits, b.set[i].Offset*wordSize
+			i++
+		}
+		res = append(res, base+trailingZeroes64(w))
+		w &= w - 1
+	}
+
+	more := w != 0 || i < len(b.set)
+	if len(res) == 0 {
+		return n, res, more
+	}
+	return res[len(res)-1] + 1, res, more
+}
+
+// Min answers the lowest index that is set in this bitset.  The
+// boolean part of the output tuple is `false` if this bitset is
+// empty.
+func (b *BitSet) Min() (uint64, bool) {
+	if len(b.set) == 0 {
+		return 0, false
+	}
+
+	el := b.set[0]
+	return el.Offset*wordSize + trailingZeroes64(el.Bits), true
+}
+
+// Max answers the highest index that is set in this bitset.  The
+// boolean part of the output tuple is `false` if this bitset is
+// empty.
+func (b *BitSet) Max() (uint64, bool) {
+	if len(b.set) == 0 {
+		return 0, false
+	}
+
+	el := b.set[len(b.set)-1]
+	return el.Offset*wordSize + modWordSize - uint64(bits.LeadingZeros64(el.Bits)), true
+}
+
+// Bits answers a sequence of the indices of the set bits in this
+// bitset, in ascending order.  The blocks are walked once, so that a
+// complete iteration is linear in the size of this bitset.
+//
+// Example usage:
+//   for idx := range set.Bits() {
+//       ...
+//   }
+//
+// N.B. This bitset must not be modified during iteration.
+func (b *BitSet) Bits() iter.Seq[uint64] {
+	return b.ForEach
+}
+
+// ForEach invokes the given function for each bit that is set in this
+// bitset, in ascending order, until it answers `false`.  The blocks
+// are walked once.
+//
+// N.B. This bitset must not be modified during iteration.
+func (b *BitSet) ForEach(fn func(uint64) bool) {
+	for _, el := range b.set {
+		base := el.Offset * wordSize
+		for w := el.Bits; w != 0; w &= w - 1 {
+			if !fn(base + trailingZeroes64(w)) {
+				return
+			}
+		}
+	}
+}
+
+// ForEachBlock invokes the given function for each block of this
+// bitset, in ascending order of offset, until it answers `false`.  The
+// function receives the offset of the block -- its index in units of
+// 64-bit words -- and its bits.  Blocks without any bits set are
+// skipped.
+//
+// N.B. This bitset must not be modified during iteration.
+//
+// Example usage:
+//   set.ForEachBlock(func(off, bits uint64) bool {
+//       // bit `i` of `bits` stands for the index `off*64 + i`
+//       return true
+//   })
+func (b *BitSet) ForEachBlock(fn func(offset, bits uint64) bool) {
+	for _, el := range b.set {
+		if el.Bits == 0 {
+			continue
+		}
+		if !fn(el.Offset, el.Bits) {
+			return
+		}
+	}
+}
+
+// Iterator iterates over the set bits in a bitset, in ascending
+// order.  It is answered by `Iterator`.  Unlike a loop over
+// `NextSet`, it remembers its position, so that each call to `Next`
+// is amortised O(1).
+//
+// N.B. The bitset must not be modified while it is being iterated
+// over.
+type Iterator struct {
+	set blockAry
+	i   int    // current block
+	w   uint64 // bits of the current block yet to be answered
+}
+
+// Iterator answers an iterator over the set bits in this bitset.
+//
+// Example usage:
+//   it := set.Iterator()
+//   for idx, ok := it.Next(); ok; idx, ok = it.Next() {
+//       ...
+//   }
+func (b *BitSet) Iterator() *Iterator {
+	return &Iterator{set: b.set, i: -1}
+}
+
+// Next answers the next set bit.  The boolean part of the output
+// tuple is `false` when there are no more set bits.
+func (it *Iterator) Next() (uint64, bool) {
+	for it.w == 0 {
+		it.i++
+		if it.i >= len(it.set) {
+			it.i = len(it.set)
+			return 0, false
+		}
+		it.w = it.set[it.i].Bits
+	}
+
+	idx := it.set[it.i].Offset*wordSize + trailingZeroes64(it.w)
+	it.w &= it.w - 1
+	return idx, true
+}
+
+// blockRun is a sequence of blocks, at indices [lo, hi) of a
+// `blockAry`, with consecutive offsets, all of whose bits are set.
+type blockRun struct {
+	lo, hi int
+}
+
+// buildRunIndex answers the maximal runs of full words in this
+// bitset, in ascending order.
+func (b *BitSet) buildRunIndex() []blockRun {
+	var runs []blockRun
+
+	lb := len(b.set)
+	for i := 0; i < lb; {
+		if b.set[i].Bits != allOnes {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < lb && b.set[j].Bits == allOnes && b.set[j].Offset == b.set[j-1].Offset+1 {
+			j++
+		}
+		runs = append(runs, blockRun{i, j})
+		i = j
+	}
+	return runs
+}
+
+// RunIterator iterates over the maximal runs of consecutive set bits
+// in a bitset, in ascending order.  It is answered by
+// `IteratorOverRuns`.
+//
+// N.B. The bitset must not be modified while it is being iterated
+// over.
+type RunIterator struct {
+	set  blockAry
+	runs []blockRun
+	r    int    // current run of full words
+	i    int    // current block
+	bit  uint64 // next bit to examine in the current block
+}
+
+// IteratorOverRuns answers an iterator over the runs of consecutive
+// set bits in this bitset.  Runs of full words are skipped in a
+// single step, making this efficient for dense regions.
+//
+// Example usage:
+//   it := set.IteratorOverRuns()
+//   for start, end, ok := it.Next(); ok; start, end, ok = it.Next() {
+//       ...
+//   }
+func (b *BitSet) IteratorOverRuns() *RunIterator {
+	return &RunIterator{set: b.set, runs: b.buildRunIndex()}
+}
+
+// Next answers the next run of set bits, as the half-open range
+// [start, end).  The boolean part of the output tuple is `false` when
+// there are no more runs.
+func (it *RunIterator) Next() (uint64, uint64, bool) {
+	a := it.set
+
+	var w uint64
+	for ; it.i < len(a); it.i, it.bit = it.i+1, 0 {
+		w = a[it.i].Bits &^ (1<<it.bit - 1)
+		if w != 0 {
+			break
+		}
+	}
+	if it.i == len(a) {
+		return 0, 0, false
+	}
+
+	s := trailingZeroes64(w)
+	start := a[it.i].Offset*wordSize + s
+	if w>>s != allOnes>>s {
+		n := trailingZeroes64(^(w >> s))
+		if s+n < wordSize {
+			it.bit = s + n
+			return start, start + n, true
+		}
+	}
+
+	// This run reaches the end of the word; extend it across the
+	// following blocks, skipping whole runs of full words.
+	end := a[it.i].Offset*wordSize + wordSize
+	it.i, it.bit = it.i+1, 0
+	for it.i < len(a) && a[it.i].Offset*wordSize == end {
+		for it.r < len(it.runs) && it.runs[it.r].hi <= it.i {
+			it.r++
+		}
+		if it.r < len(it.runs) && it.runs[it.r].lo <= it.i {
+			hi := it.runs[it.r].hi
+			end = a[hi-1].Offset*wordSize + wordSize
+			it.i = hi
+			continue
+		}
+
+		// Not a full word.
+		n := trailingZeroes64(^a[it.i].Bits)
+		it.bit = n
+		return start, end + n, true
+	}
+
+	return start, end, true
+}
+
+// RunLengths answers the maximal runs of consecutive set bits in this
+// bitset, in ascending order, as (start, length) pairs.
+func (b *BitSet) RunLengths() [][2]uint64 {
+	var res [][2]uint64
+	it := b.IteratorOverRuns()
+	for start, end, ok := it.Next(); ok; start, end, ok = it.Next() {
+		res = append(res, [2]uint64{start, end - start})
+	}
+	return res
+}
+
+// MatchesRuns answers `true` iff the given (start, length) pairs are
+// exactly the runs answered by `RunLengths`.
+func (b *BitSet) MatchesRuns(runs [][2]uint64) bool {
+	k := 0
+	it := b.IteratorOverRuns()
+	for start, end, ok := it.Next(); ok; start, end, ok = it.Next() {
+		if k >= len(runs) || runs[k] != [2]uint64{start, end - start} {
+			return false
+		}
+		k++
+	}
+	return k == len(runs)
+}
+
+// MissingInRange answers the indices in the range [start, end), in
+// ascending order, of the bits that are *not* set in this bitset.
+func (b *BitSet) MissingInRange(start, end uint64) []uint64 {
+	res := []uint64{}
+	if start >= end {
+		return res
+	}
+
+	lo, _ := offsetBits(start)
+	hi, _ := offsetBits(end - 1)
+	i, _ := b.set.find(lo)
+	for off := lo; ; off++ {
+		w := uint64(0)
+		if i < len(b.set) && b.set[i].Offset == off {
+			w = b.set[i].Bits
+			i++
+		}
+
+		base := off * wordSize
+		for m := ^w & rangeMask(off, start, end); m > 0; m &= m - 1 {
+			res = append(res, base+trailingZeroes64(m))
+		}
+		if off == hi {
+			break
+		}
+	}
+	return res
+}
+
+// ClearAll resets this bitset.  It retains the allocated storage, as
+// does `Reset`.
+func (b *BitSet) ClearAll() *BitSet {
+	b.set = b.set[:0]
+	b.card, b.cardOK = 0, 1
+	return b
+}
+
+// Reset clears this bitset, retaining its allocated storage for reuse.
+// Bitsets kept in an object pool (such as a `sync.Pool`) should be
+// `Reset` before being returned to it.
+func (b *BitSet) Reset() {
+	b.ClearAll()
+}
+
+// Release clears this bitset, and drops its storage, so that the
+// garbage collector can reclaim it.  Use it for bitsets that will not
+// be reused soon, rather than for pooled ones.
+func (b *BitSet) Release() {
+	b.set = nil
+	b.card, b.cardOK = 0, 1
+}
+
+// Compact re-allocates the storage of this bitset to fit its blocks
+// exactly, releasing any spare capacity left by earlier growth.  It
+// suits long-lived bitsets that have shrunk considerably.
+func (b *BitSet) Compact() *BitSet {
+	if cap(b.set) == len(b.set) {
+		return b
+	}
+
+	set := make(blockAry, len(b.set))
+	copy(set, b.set)
+	b.set = set
+	return b
+}
+
+// Grow reserves storage in this bitset for blocks up to that of the
+// given index, so that setting bits up to it does not reallocate.  It
+// does not change the bits that are set.
+//
+// N.B. As with the size hint of `New`, never more than `maxHintBlocks`
+// blocks are reserved, so that a high index, up to `math.MaxUint64`,
+// does not allocate the whole range up front.
+func (b *BitSet) Grow(maxIndex uint64) *BitSet {
+	off, _ := offsetBits(maxIndex)
+	if n := int(min(off, maxHintBlocks-1)) + 1; n > len(b.set) {
+		b.set = slices.Grow(b.set, n-len(b.set))
+	}
+	return b
+}
+
+// Optimize removes any blocks without bits set from this bitset, as
+// may be read with `ValidateOnRead` turned off, and then compacts its
+// storage as `Compact` does.  It does not change the bits that are
+// set.  It suits normalising a bitset before it is serialised or
+// compared with `Equal`.
+func (b *BitSet) Optimize() *BitSet {
+	b.prune()
+	return b.Compact()
+}
+
+// Clone answers a copy of this bitset.
+func (b *BitSet) Clone() *BitSet {
+	var c BitSet
+	c.set = make(blockAry, len(b.set))
+	copy(c.set, b.set)
+	if n, ok := b.cached(); ok {
+		c.card, c.cardOK = n, 1
+	}
+	return &c
+}
+
+// Copy copies this bitset into the destination bitset, replacing its
+// prior contents.  The destination's storage is reused when it is
+// large enough.  It answers the size of the destination bitset.
+func (b *BitSet) Copy(c *BitSet) int {
+	if c == nil {
+		return 0
+	}
+
+	if cap(c.set) < len(b.set) {
+		c.set = make(blockAry, len(b.set))
+	} else {
+		c.set = c.set[:len(b.set)]
+	}
+	copy(c.set, b.set)
+	c.invalidate()
+	if n, ok := b.cached(); ok {
+		c.card, c.cardOK = n, 1
+	}
+	return len(c.set) * 2 * binary.Size(uint64(0))
+}
+
+// Checkpoint captures the current state of this bitset, and answers a
+// function that restores this bitset to that state.  The function can
+// be invoked any number of times.
+func (b *BitSet) Checkpoint() func() {
+	snap := b.Clone()
+	return func() {
+		b.set = append(b.set[:0], snap.set...)
+		b.card, b.cardOK = snap.card, snap.cardOK
+	}
+}
+
+// Count is an alias for `Cardinality`.
+func (b *BitSet) Count() uint64 {
+	return b.Cardinality()
+}
+
+// Cardinality answers the number of bits in this bitset that are set
+// to `1`.  The answer is cached, and maintained by single-bit updates,
+// so that repeated calls are O(1).  Concurrent calls on a bitset that
+// is not being modified are safe.
+func (b *BitSet) Cardinality() uint64 {
+	c, ok := b.cached()
+	if !ok {
+		c = popcountSet(b.set)
+		b.cache(c)
+	}
+	return c
+}
+
+// CardinalityParallel is similar to `Cardinality`, but splits the
+// blocks of this bitset into the given number of contiguous shards,
+// and counts each shard in its own goroutine.  Sets too small to
+// benefit are counted serially.
+func (b *BitSet) CardinalityParallel(shards int) uint64 {
+	if c, ok := b.cached(); ok {
+		return c
+	}
+
+	lb := len(b.set)
+	shards = min(shards, lb/minShardBlocks)
+	if shards < 2 {
+		return b.Cardinality()
+	}
+
+	counts := make([]uint64, shards)
+	var wg sync.WaitGroup
+	for k := 0; k < shards; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			counts[k] = popcountSet(b.set[k*lb/shards : (k+1)*lb/shards])
+		}(k)
+	}
+	wg.Wait()
+
+	var c uint64
+	for _, n := range counts {
+		c += n
+	}
+	b.cache(c)
+	return c
+}
+
+// Rank answers the number of bits in this bitset that are set, at
+// indices strictly less than the given index.
+//
+// N.B. This takes time linear in the number of blocks below the given
+// index.  Should that become a bottleneck, a cached prefix sum of
+// block popcounts would make it logarithmic.
+func (b *BitSet) Rank(n uint64) uint64 {
+	off, bit := offsetBits(n)
+
+	var r uint64
+	for _, el := range b.set {
+		if el.Offset > off {
+			break
+		}
+		if el.Offset == off {
+			r += popcount(el.Bits & (1<<bit - 1))
+			break
+		}
+		r += popcount(el.Bits)
+	}
+	return r
+}
+
+// Select answers the index of the `k`-th set bit (counting from `0`)
+// in this bitset.  The boolean part of the output tuple is `false`
+// when this bitset has `k` or fewer bits set.
+func (b *BitSet) Select(k uint64) (uint64, bool) {
+	for _, el := range b.set {
+		c := popcount(el.Bits)
+		if k >= c {
+			k -= c
+			continue
+		}
+
+		w := el.Bits
+		for ; k > 0; k-- {
+			w &= w - 1
+		}
+		return el.Offset*wordSize + trailingZeroes64(w), true
+	}
+	return 0, false
+}
+
+// PopcountHistogram answers the number of blocks in this bitset,
+// indexed by the number of bits set in each.  Since empty blocks are
+// not stored, the count at index `0` is usually `0`.
+func (b *BitSet) PopcountHistogram() [wordSize + 1]uint64 {
+	var h [wordSize + 1]uint64
+	for _, el := range b.set {
+		h[popcount(el.Bits)]++
+	}
+	return h
+}
+
+// WordEntropy answers the Shannon entropy, in bits, of the
+// distribution of the number of bits set per block, as counted by
+// `PopcountHistogram`.  Low entropy indicates that the blocks are
+// similarly filled.  It answers `0` for an empty bitset.
+func (b *BitSet) WordEntropy() float64 {
+	lb := len(b.set)
+	if lb == 0 {
+		return 0
+	}
+
+	e := 0.0
+	for _, n := range b.PopcountHistogram() {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(lb)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// CoverageSummary answers the lowest and the highest bits set in this
+// bitset, the number of bits set, and the percentage of the bits in
+// the range [lo, hi] that are set.  It answers zeroes for an empty
+// bitset.
+func (b *BitSet) CoverageSummary() (lo, hi, setCount uint64, fillPct float64) {
+	lb := len(b.set)
+	if lb == 0 {
+		return 0, 0, 0, 0
+	}
+
+	first, last := b.set[0], b.set[lb-1]
+	lo = first.Offset*wordSize + trailingZeroes64(first.Bits)
+	hi = last.Offset*wordSize + uint64(bits.Len64(last.Bits)) - 1
+	setCount = popcountSet(b.set)
+	fillPct = 100 * float64(setCount) / (float64(hi-lo) + 1)
+	return lo, hi, setCount, fillPct
+}
+
+// ApproxCardinality estimates the number of bits in this bitset that
+// are set to `1`, by counting those in a random sample of
+// `sampleBlocks` blocks, and scaling the count by the total number of
+// blocks.  The sample is drawn using the given source of randomness,
+// or the default source when `rnd` is `nil`.  When `sampleBlocks` is
+// at least the number of blocks, it answers the exact cardinality.
+//
+// The estimate is unbiased.  Its standard error is
+// `N*σ/√k * √((N-k)/(N-1))`, where `N` is the number of blocks, `k` is
+// `sampleBlocks`, and `σ` is the standard deviation of the number of
+// bits set per block.  Since every block has between 1 and 64 bits
+// set, `σ` is at most 31.5; it is usually much smaller for sets whose
+// density is uniform.
+func (b *BitSet) ApproxCardinality(sampleBlocks int, rnd *rand.Rand) uint64 {
+	lb := len(b.set)
+	if sampleBlocks >= lb {
+		return b.Cardinality()
+	}
+	if sampleBlocks <= 0 {
+		return 0
+	}
+
+	intn := rand.Int63n
+	if rnd != nil {
+		intn = rnd.Int63n
+	}
+
+	// Floyd's algorithm samples distinct blocks, in `O(sampleBlocks)`.
+	seen := make(map[int]struct{}, sampleBlocks)
+	c := uint64(0)
+	for j := lb - sampleBlocks; j < lb; j++ {
+		k := int(intn(int64(j + 1)))
+		if _, ok := seen[k]; ok {
+			k = j
+		}
+		seen[k] = struct{}{}
+		c += popcount(b.set[k].Bits)
+	}
+
+	return uint64(float64(c)*float64(lb)/float64(sampleBlocks) + 0.5)
+}
+
+// Equal answers `true` iff the two sets have the same bits set to
+// `1`.
+func (b *BitSet) Equal(c *BitSet) bool {
+	if c == nil {
+		return false
+	}
+	lb := len(b.set)
+	if lb != len(c.set) {
+		return false
+	}
+	if lb == 0 { // both are empty
+		return true
+	}
+
+	for i, el := range b.set {
+		cel := c.set[i]
+		if el.Offset != cel.Offset || el.Bits != cel.Bits {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualSemantic answers `true` iff the two sets have the same bits set
+// to `1`.  Unlike `Equal`, it does not assume that the sets are free
+// of blocks without any bits set, as may be the case with a set read
+// with `ValidateOnRead` turned off.
+func (b *BitSet) EqualSemantic(c *BitSet) bool {
+	if c == nil {
+		return false
+	}
+
+	lb, lc := len(b.set), len(c.set)
+	i, j := 0, 0
+	for {
+		for i < lb && b.set[i].Bits == 0 {
+			i++
+		}
+		for j < lc && c.set[j].Bits == 0 {
+			j++
+		}
+		if i == lb || j == lc {
+			return i == lb && j == lc
+		}
+		if b.set[i] != c.set[j] {
+			return false
+		}
+		i, j = i+1, j+1
+	}
+}
+
+// Hash answers a 64-bit hash of the bits set in this bitset.  Sets
+// that are `EqualSemantic` answer the same hash, since blocks without
+// any bits set are skipped.
+//
+// The hash is FNV-1a over the big-endian offset and bits of each
+// block, in ascending order of offset.  This definition is stable
+// across versions of this package, so hashes may be persisted.  It is
+// *not* a cryptographic hash.
+func (b *BitSet) Hash() uint64 {
+	h := fnv.New64a()
+	var buf [16]byte
+	for _, el := range b.set {
+		if el.Bits == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint64(buf[:8], el.Offset)
+		binary.BigEndian.PutUint64(buf[8:], el.Bits)
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// CommonPrefixLen answers the number of leading blocks that are
+// identical in this bitset and the given bitset.
+func (b *BitSet) CommonPrefixLen(c *BitSet) int {
+	if c == nil {
+		return 0
+	}
+
+	n := 0
+	for n < len(b.set) && n < len(c.set) && b.set[n] == c.set[n] {
+		n++
+	}
+	return n
+}
+
+// CommonSuffixLen answers the number of trailing blocks that are
+// identical in this bitset and the given bitset.
+func (b *BitSet) CommonSuffixLen(c *BitSet) int {
+	if c == nil {
+		return 0
+	}
+
+	lb := len(b.set)
+	lc := len(c.set)
+	n := 0
+	for n < lb && n < lc && b.set[lb-1-n] == c.set[lc-1-n] {
+		n++
+	}
+	return n
+}
+
+// DiffLimit caps the number of indices listed in each of the slices
+// of a `DiffReport`.
+var DiffLimit = 1000
+
+// DiffReport describes how two bitsets differ.  It is answered by
+// `Diff`.
+type DiffReport struct {
+	// OnlyInB lists the indices set only in the receiver.
+	OnlyInB []uint64
+
+	// OnlyInC lists the indices set only in the argument.
+	OnlyInC []uint64
+
+	// Common is the number of indices set in both.
+	Common uint64
+
+	// Truncated is `true` if either list was capped at `DiffLimit`.
+	Truncated bool
+}
+
+// appendBits appends the indices of the bits set in the given word,
+// up to a total of `limit` indices.  It answers `true` if some bits
+// could not be appended.
+func appendBits(dst []uint64, off, w uint64, limit int) ([]uint64, bool) {
+	base := off * wordSize
+	for w > 0 {
+		if len(dst) >= limit {
+			return dst, true
+		}
+		dst = append(dst, base+trailingZeroes64(w))
+		w &= w - 1
+	}
+	return dst, false
+}
+
+// Diff compares this bitset with the given bitset, in a single pass,
+// and answers a report of their differences.  A `nil` argument is
+// treated as an empty bitset.
+func (b *BitSet) Diff(c *BitSet) DiffReport {
+	var res DiffReport
+	var cset blockAry
+	if c != nil {
+		cset = c.set
+	}
+
+	add := func(dst []uint64, off, w uint64) []uint64 {
+		dst, tr := appendBits(dst, off, w, DiffLimit)
+		res.Truncated = res.Truncated || tr
+		return dst
+	}
+
+	lb := len(b.set)
+	lc := len(cset)
+	i, j := 0, 0
+	for i < lb || j < lc {
+		switch {
+		case j == lc || (i < lb && b.set[i].Offset < cset[j].Offset):
+			res.OnlyInB = add(res.OnlyInB, b.set[i].Offset, b.set[i].Bits)
+			i++
+
+		case i == lb || b.set[i].Offset > cset[j].Offset:
+			res.OnlyInC = add(res.OnlyInC, cset[j].Offset, cset[j].Bits)
+			j++
+
+		default:
+			bbl, cbl := b.set[i], cset[j]
+			res.OnlyInB = add(res.OnlyInB, bbl.Offset, bbl.Bits&^cbl.Bits)
+			res.OnlyInC = add(res.OnlyInC, cbl.Offset, cbl.Bits&^bbl.Bits)
+			res.Common += popcount(bbl.Bits & cbl.Bits)
+			i, j = i+1, j+1
+		}
+	}
+
+	return res
+}
+
+// ValidateOnRead makes `ReadFrom` and `ReadFromChecked` check the
+// de-serialised data using `Valid`, and reject it if it is malformed.
+var ValidateOnRead = false
+
+// Valid checks the invariants on which the operations of this bitset
+// rely.  It answers `ErrBlocksOutOfOrder` if the offsets of its blocks
+// are not strictly ascending, and `ErrEmptyBlock` if any of its blocks
+// has no bits set.  It is useful for bitsets de-serialised from
+// untrusted input.
+func (b *BitSet) Valid() error {
+	for i, el := range b.set {
+		if el.Bits == 0 {
+			return ErrEmptyBlock
+		}
+		if i > 0 && el.Offset <= b.set[i-1].Offset {
+			return ErrBlocksOutOfOrder
+		}
+	}
+	return nil
+}
+
+// prune removes empty blocks from this bitset, in a single pass that
+// moves the surviving blocks forward.
+func (b *BitSet) prune() {
+	j := 0
+	for _, el := range b.set {
+		if el.Bits != 0 {
+			b.set[j] = el
+			j++
+		}
+	}
+	b.set = b.set[:j]
+}
+
+// Difference performs a 'set minus' of the given bitset from this
+// bitset.
+func (b *BitSet) Difference(c *BitSet) *BitSet {
+	if c == nil {
+		return nil
+	}
+
+	lb := len(b.set)
+	lc := len(c.set)
+	res := &BitSet{set: make(blockAry, 0, lb)}
+	i, j := 0, 0
+	for i < lb && j < lc {
+		bbl, cbl := b.set[i], c.set[j]
+
+		switch {
+		case bbl.Offset < cbl.Offset:
+			res.appendBlock(bbl)
+			i++
+
+		case bbl.Offset == cbl.Offset:
+			var t block
+			t.Offset = bbl.Offset
+			t.Bits = bbl.Bits &^ cbl.Bits
+			res.appendBlock(t)
+			i, j = i+1, j+1
+
+		default:
+			j++
+		}
+	}
+	for ; i < lb; i++ {
+		res.appendBlock(b.set[i])
+	}
+
+	res.prune()
+	res.cardOK = 1
+	return res
+}
+
+// InPlaceDifference performs a 'set minus' of the given bitset from
+// this bitset, updating this bitset itself.
+func (b *BitSet) InPlaceDifference(c *BitSet) *BitSet {
+	if c == nil {
+		return nil
+	}
+
+	lb := len(b.set)
+	lc := len(c.set)
+	i, j := 0, 0
+	for i < lb && j < lc {
+		bbl, cbl := b.set[i], c.set[j]
+
+		switch {
+		case bbl.Offset < cbl.Offset:
+			i++
+
+		case bbl.Offset == cbl.Offset:
+			bbl.Bits &^= cbl.Bits
+			b.set[i] = bbl
+			i, j = i+1, j+1
+
+		default:
+			j++
+		}
+	}
+
+	b.prune()
+	b.invalidate()
+	return b
+}
+
+// DifferenceRange answers a copy of this bitset, with all the bits in
+// the range [start, end) removed.  It answers `nil` if `start > end`.
+func (b *BitSet) DifferenceRange(start, end uint64) *BitSet {
+	if start > end {
+		return nil
+	}
+
+	return b.Clone().InPlaceDifferenceRange(start, end)
+}
+
+// InPlaceDifferenceRange removes all the bits in the range [start,
+// end) from this bitset, updating this bitset itself.  It answers
+// `nil` if `start > end`.
+func (b *BitSet) InPlaceDifferenceRange(start, end uint64) *BitSet {
+	if start > end {
+		return nil
+	}
+	if start == end {
+		return b
+	}
+
+	lo, _ := offsetBits(start)
+	hi, _ := offsetBits(end - 1)
+	k := 0
+	for _, el := range b.set {
+		if el.Offset >= lo && el.Offset <= hi {
+			el.Bits &^= rangeMask(el.Offset, start, end)
+			if el.Bits == 0 {
+				continue
+			}
+		}
+		b.set[k] = el
+		k++
+	}
+
+	b.set = b.set[:k]
+	b.invalidate()
+	return b
+}
+
+// ClearCongruent clears every bit `i` in this bitset for which `i % m
+// == r`, updating this bitset itself.  It answers `nil` if `m` is
+// `0`.
+func (b *BitSet) ClearCongruent(m, r uint64) *BitSet {
+	if m == 0 {
+		return nil
+	}
+	if r >= m {
+		return b
+	}
+
+	// For `m <= 64`, every word has some bits to clear, and the masks
+	// repeat.  Cache them by the phase of the word's first bit.
+	var masks []uint64
+	if m <= wordSize {
+		masks = make([]uint64, m)
+	}
+
+	k := 0
+	for _, el := range b.set {
+		p := (el.Offset * wordSize) % m
+		var mask uint64
+		if masks != nil {
+			mask = masks[p]
+			if mask == 0 {
+				mask = congruentMask(p, m, r)
+				masks[p] = mask
+			}
+		} else {
+			mask = congruentMask(p, m, r)
+		}
+
+		el.Bits &^= mask
+		if el.Bits != 0 {
+			b.set[k] = el
+			k++
+		}
+	}
+
+	b.set = b.set[:k]
+	b.invalidate()
+	return b
+}
+
+// congruentMask answers a mask of the bits `i` of a word, for which
+// `(p + i) % m == r`.
+func congruentMask(p, m, r uint64) uint64 {
+	var i uint64
+	if r >= p {
+		i = r - p
+	} else {
+		i = r + (m - p)
+	}
+
+	mask := uint64(0)
+	for i < wordSize {
+		mask |= 1 << i
+		if m >= wordSize {
+			break
+		}
+		i += m
+	}
+	return mask
+}
+
+// DifferenceCardinality answers the cardinality of the difference set
+// between this bitset and the given bitset.  This does *not*
+// construct an intermediate bitset.
+func (b *BitSet) DifferenceCardinality(c *BitSet) (uint64, error) {
+	if c == nil {
+		return 0, ErrNilArgument
+	}
+
+	return popcountSetAndNot(b.set, c.set), nil
+}
+
+// MarginalGain answers the number of bits that the given bitset would
+// add to this bitset in a union, i.e. the cardinality of the given
+// bitset minus this one.  This suits greedy set-cover algorithms, in
+// which this bitset accumulates the chosen bitsets.  It answers `0`
+// for a `nil` argument.
+func (b *BitSet) MarginalGain(c *BitSet) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	return popcountSetAndNot(c.set, b.set)
 }
 
 // Intersection performs a 'set intersection' of the given bitset with
@@ -505,9 +1941,9 @@ func (b *BitSet) Intersection(c *BitSet) *BitSet {
 		return nil
 	}
 
-	res := new(BitSet)
 	lb := len(b.set)
 	lc := len(c.set)
+	res := &BitSet{set: make(blockAry, 0, min(lb, lc))}
 	i, j := 0, 0
 	for i < lb && j < lc {
 		bbl, cbl := b.set[i], c.set[j]
@@ -520,7 +1956,7 @@ func (b *BitSet) Intersection(c *BitSet) *BitSet {
 			var t block
 			t.Offset = bbl.Offset
 			t.Bits = bbl.Bits & cbl.Bits
-			res.set = append(res.set, t)
+			res.appendBlock(t)
 			i, j = i+1, j+1
 
 		default:
@@ -529,6 +1965,7 @@ func (b *BitSet) Intersection(c *BitSet) *BitSet {
 	}
 
 	res.prune()
+	res.cardOK = 1
 	return res
 }
 
@@ -564,6 +2001,7 @@ func (b *BitSet) InPlaceIntersection(c *BitSet) *BitSet {
 	}
 
 	b.prune()
+	b.invalidate()
 	return b
 }
 
@@ -578,43 +2016,77 @@ func (b *BitSet) IntersectionCardinality(c *BitSet) (uint64, error) {
 	return popcountSetAnd(b.set, c.set), nil
 }
 
+// ForEachIn invokes the given function for each bit that is set in
+// both this bitset and the given bitset, in ascending order, until it
+// answers `false`.  This does *not* construct an intermediate bitset.
+func (b *BitSet) ForEachIn(c *BitSet, fn func(uint64) bool) {
+	if c == nil {
+		return
+	}
+
+	lb := len(b.set)
+	lc := len(c.set)
+	i, j := 0, 0
+	for i < lb && j < lc {
+		bbl, cbl := b.set[i], c.set[j]
+
+		switch {
+		case bbl.Offset < cbl.Offset:
+			i++
+
+		case bbl.Offset == cbl.Offset:
+			base := bbl.Offset * wordSize
+			for w := bbl.Bits & cbl.Bits; w > 0; w &= w - 1 {
+				if !fn(base + trailingZeroes64(w)) {
+					return
+				}
+			}
+			i, j = i+1, j+1
+
+		default:
+			j++
+		}
+	}
+}
+
 // Union performs a 'set union' of the given bitset with this bitset.
 func (b *BitSet) Union(c *BitSet) *BitSet {
 	if c == nil {
 		return nil
 	}
 
-	res := new(BitSet)
 	lb := len(b.set)
 	lc := len(c.set)
+	res := &BitSet{set: make(blockAry, 0, lb+lc)}
 	i, j := 0, 0
 	for i < lb && j < lc {
 		bbl, cbl := b.set[i], c.set[j]
 
 		switch {
 		case bbl.Offset < cbl.Offset:
-			res.set = append(res.set, bbl)
+			res.appendBlock(bbl)
 			i++
 
 		case bbl.Offset == cbl.Offset:
 			var t block
 			t.Offset = bbl.Offset
 			t.Bits = bbl.Bits | cbl.Bits
-			res.set = append(res.set, t)
+			res.appendBlock(t)
 			i, j = i+1, j+1
 
 		default:
-			res.set = append(res.set, cbl)
+			res.appendBlock(cbl)
 			j++
 		}
 	}
 	for ; i < lb; i++ {
-		res.set = append(res.set, b.set[i])
+		res.appendBlock(b.set[i])
 	}
 	for ; j < lc; j++ {
-		res.set = append(res.set, c.set[j])
+		res.appendBlock(c.set[j])
 	}
 
+	res.cardOK = 1
 	return res
 }
 
@@ -627,133 +2099,491 @@ func (b *BitSet) InPlaceUnion(c *BitSet) *BitSet {
 
 	lb := len(b.set)
 	lc := len(c.set)
+	res := make(blockAry, 0, lb+lc)
 	i, j := 0, 0
-	for {
-		if i >= lb || j >= lc {
+	for i < lb && j < lc {
+		bbl, cbl := b.set[i], c.set[j]
+
+		switch {
+		case bbl.Offset < cbl.Offset:
+			res = append(res, bbl)
+			i++
+
+		case bbl.Offset == cbl.Offset:
+			res = append(res, block{bbl.Offset, bbl.Bits | cbl.Bits})
+			i, j = i+1, j+1
+
+		default:
+			res = append(res, cbl)
+			j++
+		}
+	}
+	res = append(res, b.set[i:]...)
+	res = append(res, c.set[j:]...)
+
+	b.set = res
+	b.invalidate()
+	return b
+}
+
+// InPlaceUnionRange performs a 'set union' of those bits of the given
+// bitset that lie in the range [start, end) with this bitset, updating
+// this bitset itself.  It answers `nil` if `start > end`.
+func (b *BitSet) InPlaceUnionRange(c *BitSet, start, end uint64) *BitSet {
+	if c == nil || start > end {
+		return nil
+	}
+	if start == end {
+		return b
+	}
+
+	lo, _ := offsetBits(start)
+	hi, _ := offsetBits(end - 1)
+	res := make(blockAry, 0, len(b.set))
+	lb := len(b.set)
+	i := 0
+	first, _ := c.set.find(lo)
+	for _, cbl := range c.set[first:] {
+		if cbl.Offset > hi {
 			break
 		}
+		w := cbl.Bits & rangeMask(cbl.Offset, start, end)
+		if w == 0 {
+			continue
+		}
+
+		for i < lb && b.set[i].Offset < cbl.Offset {
+			res = append(res, b.set[i])
+			i++
+		}
+		if i < lb && b.set[i].Offset == cbl.Offset {
+			w |= b.set[i].Bits
+			i++
+		}
+		res = append(res, block{cbl.Offset, w})
+	}
+	res = append(res, b.set[i:]...)
+
+	b.set = res
+	b.invalidate()
+	return b
+}
+
+// UnionCardinality answers the cardinality of the union set between
+// this bitset and the given bitset.  This does *not* construct an
+// intermediate bitset.
+func (b *BitSet) UnionCardinality(c *BitSet) (uint64, error) {
+	if c == nil {
+		return 0, ErrNilArgument
+	}
+
+	return popcountSetOr(b.set, c.set), nil
+}
+
+// SymmetricDifference performs a 'set symmetric difference' of the
+// given bitset with this bitset.
+func (b *BitSet) SymmetricDifference(c *BitSet) *BitSet {
+	if c == nil {
+		return nil
+	}
 
+	lb := len(b.set)
+	lc := len(c.set)
+	res := &BitSet{set: make(blockAry, 0, lb+lc)}
+	i, j := 0, 0
+	for i < lb && j < lc {
 		bbl, cbl := b.set[i], c.set[j]
 
 		switch {
 		case bbl.Offset < cbl.Offset:
+			res.appendBlock(bbl)
 			i++
 
 		case bbl.Offset == cbl.Offset:
-			bbl.Bits |= cbl.Bits
-			b.set[i] = bbl
+			var t block
+			t.Offset = bbl.Offset
+			t.Bits = bbl.Bits ^ cbl.Bits
+			res.appendBlock(t)
 			i, j = i+1, j+1
 
 		default:
-			b.set, _ = b.set.insert(cbl, uint32(i))
-			lb++
-			i, j = i+1, j+1
+			res.appendBlock(cbl)
+			j++
 		}
 	}
+	for ; i < lb; i++ {
+		res.appendBlock(b.set[i])
+	}
 	for ; j < lc; j++ {
-		b.set = append(b.set, c.set[j])
+		res.appendBlock(c.set[j])
+	}
+
+	res.prune()
+	res.cardOK = 1
+	return res
+}
+
+// InPlaceSymmetricDifference performs a 'set symmetric difference' of
+// the given bitset with this bitset, updating this bitset itself.
+func (b *BitSet) InPlaceSymmetricDifference(c *BitSet) *BitSet {
+	if c == nil {
+		return nil
+	}
+
+	b.xorInPlace(c)
+	return b
+}
+
+// XorAssignTracked performs `InPlaceSymmetricDifference` with the
+// given bitset, and answers the number of bits that flipped from `0`
+// to `1`, and from `1` to `0`, respectively.
+func (b *BitSet) XorAssignTracked(c *BitSet) (flippedOn, flippedOff uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	return b.xorInPlace(c)
+}
+
+// xorInPlace updates this bitset to its symmetric difference with the
+// given bitset.  It answers the number of bits that flipped from `0`
+// to `1`, and from `1` to `0`, respectively.
+func (b *BitSet) xorInPlace(c *BitSet) (on, off uint64) {
+	lb := len(b.set)
+	lc := len(c.set)
+
+	// Merge from the right end, into the tail of a backing array that
+	// can hold both the bitsets.  Since the merge never writes at or
+	// before the next block of this bitset to be read, no block is
+	// overwritten before being read.
+	n := lb + lc
+	set := b.set
+	if cap(set) < n {
+		set = make(blockAry, n)
+		copy(set, b.set)
+	} else {
+		set = set[:n]
+	}
+
+	k := n
+	i, j := lb-1, lc-1
+	for i >= 0 && j >= 0 {
+		bbl, cbl := set[i], c.set[j]
+
+		var t block
+		switch {
+		case bbl.Offset > cbl.Offset:
+			t = bbl
+			i--
+
+		case bbl.Offset == cbl.Offset:
+			t = block{bbl.Offset, bbl.Bits ^ cbl.Bits}
+			on += popcount(cbl.Bits &^ bbl.Bits)
+			off += popcount(cbl.Bits & bbl.Bits)
+			i, j = i-1, j-1
+
+		default:
+			t = cbl
+			on += popcount(cbl.Bits)
+			j--
+		}
+
+		if t.Bits != 0 {
+			k--
+			set[k] = t
+		}
+	}
+	for ; i >= 0; i-- {
+		if set[i].Bits != 0 {
+			k--
+			set[k] = set[i]
+		}
+	}
+	for ; j >= 0; j-- {
+		if c.set[j].Bits != 0 {
+			k--
+			set[k] = c.set[j]
+			on += popcount(c.set[j].Bits)
+		}
+	}
+
+	b.set = append(set[:0], set[k:]...)
+	b.card += on - off
+	return on, off
+}
+
+// SymmetricDifferenceCardinality answers the cardinality of the
+// symmetric difference set between this bitset and the given bitset.
+// This does *not* construct an intermediate bitset.
+func (b *BitSet) SymmetricDifferenceCardinality(c *BitSet) (uint64, error) {
+	if c == nil {
+		return 0, ErrNilArgument
 	}
 
-	return b
+	return popcountSetXor(b.set, c.set), nil
 }
 
-// UnionCardinality answers the cardinality of the union set between
-// this bitset and the given bitset.  This does *not* construct an
-// intermediate bitset.
-func (b *BitSet) UnionCardinality(c *BitSet) (uint64, error) {
+// HammingDistance is an alias for `SymmetricDifferenceCardinality`:
+// the number of positions at which this bitset and the given bitset
+// differ.
+func (b *BitSet) HammingDistance(c *BitSet) (uint64, error) {
+	return b.SymmetricDifferenceCardinality(c)
+}
+
+// JaccardSimilarity is an alias for `Jaccard`.
+func (b *BitSet) JaccardSimilarity(c *BitSet) (float64, error) {
+	return b.Jaccard(c)
+}
+
+// Jaccard answers the Jaccard similarity, i.e. the cardinality of
+// the intersection divided by that of the union, between this bitset
+// and the given bitset.  The similarity of two empty bitsets is
+// defined to be `1`.
+func (b *BitSet) Jaccard(c *BitSet) (float64, error) {
 	if c == nil {
 		return 0, ErrNilArgument
 	}
 
-	return popcountSetOr(b.set, c.set), nil
+	u := popcountSetOr(b.set, c.set)
+	if u == 0 {
+		return 1, nil
+	}
+	return float64(popcountSetAnd(b.set, c.set)) / float64(u), nil
 }
 
-// SymmetricDifference performs a 'set symmetric difference' of the
-// given bitset with this bitset.
-func (b *BitSet) SymmetricDifference(c *BitSet) *BitSet {
+// JaccardAtLeast answers `true` if the Jaccard similarity between this
+// bitset and the given bitset is at least the given threshold.
+//
+// Since the similarity can not exceed `min(|b|, |c|) / max(|b|, |c|)`,
+// it answers `false` without a merge when that bound is below the
+// threshold.  Otherwise, the merge stops as soon as the outcome is
+// certain.  It answers `false` for a `nil` argument.
+func (b *BitSet) JaccardAtLeast(c *BitSet, threshold float64) bool {
 	if c == nil {
-		return nil
+		return false
 	}
 
-	res := new(BitSet)
+	nb, nc := b.Cardinality(), c.Cardinality()
+	if nb+nc == 0 {
+		return threshold <= 1
+	}
+	lo, hi := nb, nc
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	if float64(lo)/float64(hi) < threshold {
+		return false
+	}
+
+	// The similarity increases monotonically with the size of the
+	// intersection.
+	meets := func(inter uint64) bool {
+		return float64(inter)/float64(nb+nc-inter) >= threshold
+	}
+
+	inter := uint64(0)
+	remb, remc := nb, nc
 	lb := len(b.set)
 	lc := len(c.set)
 	i, j := 0, 0
 	for i < lb && j < lc {
+		if meets(inter) {
+			return true
+		}
+		if !meets(inter + min(remb, remc)) {
+			return false
+		}
+
 		bbl, cbl := b.set[i], c.set[j]
 
 		switch {
 		case bbl.Offset < cbl.Offset:
-			res.set = append(res.set, bbl)
+			remb -= popcount(bbl.Bits)
 			i++
 
 		case bbl.Offset == cbl.Offset:
-			var t block
-			t.Offset = bbl.Offset
-			t.Bits = bbl.Bits ^ cbl.Bits
-			res.set = append(res.set, t)
+			inter += popcount(bbl.Bits & cbl.Bits)
+			remb -= popcount(bbl.Bits)
+			remc -= popcount(cbl.Bits)
 			i, j = i+1, j+1
 
 		default:
-			res.set = append(res.set, cbl)
+			remc -= popcount(cbl.Bits)
 			j++
 		}
 	}
-	for ; i < lb; i++ {
-		res.set = append(res.set, b.set[i])
+
+	return meets(inter)
+}
+
+// JaccardMatrix answers the symmetric matrix of the pairwise Jaccard
+// similarities between the given bitsets.  A `nil` bitset is treated
+// as an empty one.
+func JaccardMatrix(sets []*BitSet) [][]float64 {
+	return JaccardMatrixParallel(sets, 1)
+}
+
+// JaccardMatrixParallel is similar to `JaccardMatrix`, but computes
+// the rows of the matrix using the given number of goroutines.
+func JaccardMatrixParallel(sets []*BitSet, workers int) [][]float64 {
+	n := len(sets)
+	as := make([]blockAry, n)
+	cards := make([]uint64, n)
+	m := make([][]float64, n)
+	for i, b := range sets {
+		if b != nil {
+			as[i] = b.set
+			cards[i] = popcountSet(b.set)
+		}
+		m[i] = make([]float64, n)
+	}
+
+	// Each row fills its upper half, and mirrors it into the lower.
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rows {
+				m[i][i] = 1
+				for j := i + 1; j < n; j++ {
+					v := 1.0
+					inter := popcountSetAnd(as[i], as[j])
+					if u := cards[i] + cards[j] - inter; u > 0 {
+						v = float64(inter) / float64(u)
+					}
+					m[i][j], m[j][i] = v, v
+				}
+			}
+		}()
 	}
-	for ; j < lc; j++ {
-		res.set = append(res.set, c.set[j])
+	for i := 0; i < n; i++ {
+		rows <- i
 	}
+	close(rows)
+	wg.Wait()
 
-	res.prune()
-	return res
+	return m
 }
 
-// InPlaceSymmetricDifference performs a 'set symmetric difference' of
-// the given bitset with this bitset, updating this bitset itself.
-func (b *BitSet) InPlaceSymmetricDifference(c *BitSet) *BitSet {
+// Agreement answers a bitset of the positions in [0, universe) at
+// which this bitset and the given bitset agree, i.e. where both have
+// their bits set, or both have them clear.  It is the complement of
+// their symmetric difference within the universe, computed in a single
+// pass.
+//
+// N.B. Since most positions in sparse bitsets are clear in both, the
+// answered bitset is usually dense, with up to `universe/64` blocks.
+func (b *BitSet) Agreement(c *BitSet, universe uint64) *BitSet {
 	if c == nil {
 		return nil
 	}
 
+	res := new(BitSet)
+	if universe == 0 {
+		return res
+	}
+
+	last, lbit := offsetBits(universe - 1)
+	res.set = make(blockAry, 0, last+1)
 	lb := len(b.set)
 	lc := len(c.set)
 	i, j := 0, 0
-	for i < lb && j < lc {
-		bbl, cbl := b.set[i], c.set[j]
-
-		switch {
-		case bbl.Offset < cbl.Offset:
+	for off := uint64(0); off <= last; off++ {
+		var bw, cw uint64
+		if i < lb && b.set[i].Offset == off {
+			bw = b.set[i].Bits
 			i++
-
-		case bbl.Offset == cbl.Offset:
-			bbl.Bits ^= cbl.Bits
-			b.set[i] = bbl
-			i, j = i+1, j+1
-
-		default:
-			b.set, _ = b.set.insert(cbl, uint32(i))
+		}
+		if j < lc && c.set[j].Offset == off {
+			cw = c.set[j].Bits
 			j++
 		}
+
+		w := ^(bw ^ cw)
+		if off == last {
+			w &= allOnes >> (modWordSize - lbit)
+		}
+		if w != 0 {
+			res.set = append(res.set, block{off, w})
+		}
 	}
-	for ; j < lc; j++ {
-		b.set = append(b.set, c.set[j])
+
+	return res
+}
+
+// ShiftLeft adds `n` to the index of every bit set in this bitset,
+// updating this bitset itself.  Bits whose indices would exceed
+// `math.MaxUint64` are dropped.
+func (b *BitSet) ShiftLeft(n uint64) *BitSet {
+	woff, s := offsetBits(n)
+	maxOff := uint64(math.MaxUint64) >> log2WordSize
+
+	res := make(blockAry, 0, len(b.set)+1)
+	for _, el := range b.set {
+		off := el.Offset + woff
+		if off > maxOff {
+			break
+		}
+		if s == 0 {
+			res = append(res, block{off, el.Bits})
+			continue
+		}
+
+		res = appendOr(res, off, el.Bits<<s)
+		if off < maxOff {
+			res = appendOr(res, off+1, el.Bits>>(wordSize-s))
+		}
 	}
 
-	b.prune()
+	b.set = res
+	b.invalidate()
 	return b
 }
 
-// SymmetricDifferenceCardinality answers the cardinality of the
-// symmetric difference set between this bitset and the given bitset.
-// This does *not* construct an intermediate bitset.
-func (b *BitSet) SymmetricDifferenceCardinality(c *BitSet) (uint64, error) {
-	if c == nil {
-		return 0, ErrNilArgument
+// ShiftRight subtracts `n` from the index of every bit set in this
+// bitset, updating this bitset itself.  Bits whose indices would fall
+// below `0` are dropped.
+func (b *BitSet) ShiftRight(n uint64) *BitSet {
+	woff, s := offsetBits(n)
+
+	i, _ := b.set.find(woff)
+	res := make(blockAry, 0, len(b.set)-i)
+	for _, el := range b.set[i:] {
+		off := el.Offset - woff
+		if s == 0 {
+			res = append(res, block{off, el.Bits})
+			continue
+		}
+
+		if off > 0 {
+			res = appendOr(res, off-1, el.Bits<<(wordSize-s))
+		}
+		res = appendOr(res, off, el.Bits>>s)
 	}
 
-	return popcountSetXor(b.set, c.set), nil
+	b.set = res
+	b.invalidate()
+	return b
+}
+
+// appendOr merges the given word into the last block of the given
+// slice if it has the given offset, and appends a new block otherwise.
+// The offset must not be less than that of the last block.  Words
+// that are `0` are ignored.
+func appendOr(a blockAry, off, w uint64) blockAry {
+	if w == 0 {
+		return a
+	}
+	if l := len(a); l > 0 && a[l-1].Offset == off {
+		a[l-1].Bits |= w
+		return a
+	}
+	return append(a, block{off, w})
 }
 
 // Complement answers a bit-wise complement of this bitset, up to the
@@ -761,6 +2591,7 @@ func (b *BitSet) SymmetricDifferenceCardinality(c *BitSet) (uint64, error) {
 //
 // N.B. Since bitset is not bounded, `a.complement().complement() !=
 // a`.  This limits the usefulness of this operation.  Use with care!
+// `ComplementWithin` is an alternative with an explicit bound.
 func (b *BitSet) Complement() *BitSet {
 	res := new(BitSet)
 
@@ -792,53 +2623,74 @@ func (b *BitSet) Complement() *BitSet {
 	rel.Bits = ^rel.Bits >> (64 - j)
 	res.set[len(res.set)-1] = rel
 
-	// '0'th bit should be ignored.
-	rel = res.set[0]
-	rel.Bits = rel.Bits >> 1
-	rel.Bits = rel.Bits << 1
-	res.set[0] = rel
-
 	res.prune()
 	return res
 }
 
-// All answers `true` if all the bits in it, up to its highest set
-// bit, are set to `1`; `false` otherwise.
+// ComplementWithin answers a bit-wise complement of this bitset over
+// the domain [0, max).  Bits of this bitset at or beyond `max` are
+// dropped.  Hence, for a bitset `a` with no bits at or beyond `max`,
+// `a.ComplementWithin(max).ComplementWithin(max)` equals `a`.
+func (b *BitSet) ComplementWithin(max uint64) *BitSet {
+	return b.Clone().FlipRange(0, max).ClearFrom(max)
+}
+
+// InPlaceComplementWithin is similar to `ComplementWithin`, but
+// rewrites this bitset itself.  The blocks are complemented within
+// the storage of this bitset, which grows only if it can not hold a
+// block for every word in the domain.
+func (b *BitSet) InPlaceComplementWithin(max uint64) *BitSet {
+	b.ClearFrom(max)
+	if max == 0 {
+		return b
+	}
+
+	// Spread the blocks out so that each word of the domain has one at
+	// the index of its offset, filling gaps with full words.  Working
+	// from the end, no block is overwritten before it is read.
+	hiOff, _ := offsetBits(max - 1)
+	n := int(hiOff) + 1
+	lb := len(b.set)
+	b.set = slices.Grow(b.set, n-lb)[:n]
+	i := lb - 1
+	for off := n - 1; off >= 0; off-- {
+		w := allOnes
+		if i >= 0 && b.set[i].Offset == uint64(off) {
+			w = ^b.set[i].Bits
+			i--
+		}
+		b.set[off] = block{uint64(off), w}
+	}
+	b.set[n-1].Bits &= rangeMask(hiOff, 0, max)
+
+	b.set = slices.DeleteFunc(b.set, func(el block) bool { return el.Bits == 0 })
+	b.invalidate()
+	return b
+}
+
+// All answers `true` if every bit from `0` up to, and including, the
+// highest set bit (see `Max`) is set to `1`; `false` otherwise.  That
+// holds vacuously for an empty bitset.
 func (b *BitSet) All() bool {
 	lb := len(b.set)
 	if lb == 0 {
-		return true // is this correct?
+		return true
 	}
 
-	off := uint64(0)
+	// Every block but the last must be full, and the blocks must be
+	// at consecutive offsets from `0`.
 	for i, el := range b.set[:lb-1] {
-		if el.Offset != off {
+		if el.Offset != uint64(i) || el.Bits != allOnes {
 			return false
 		}
-		if el.Offset > 0 && i < lb-1 {
-			if el.Bits != allOnes {
-				return false
-			}
-		}
-
-		off++
 	}
 
-	sel := b.set[lb-1]
-	w := uint64(0)
-	cp := popcount(sel.Bits)
-	if sel.Offset == 0 { // handle '0'th bit
-		cp++
-		w = (sel.Bits | 1) & allOnes
-	} else {
-		w = sel.Bits ^ allOnes
-	}
-	tz := trailingZeroes64(w)
-	if cp != tz {
+	// The last block must be a solid run of bits from its lowest.
+	last := b.set[lb-1]
+	if last.Offset != uint64(lb-1) {
 		return false
 	}
-
-	return true
+	return bits.TrailingZeros64(^last.Bits) == bits.OnesCount64(last.Bits)
 }
 
 // IsEmpty answers `true` if this bitset is empty; `false` otherwise.
@@ -905,14 +2757,115 @@ func (b *BitSet) IsStrictSuperSet(c *BitSet) bool {
 	return true
 }
 
+// IsSubSet answers `true` if all of this bitset's elements are
+// included in the given bitset.  An empty bitset is a subset of every
+// bitset; a `nil` argument is treated as an empty bitset.
+func (b *BitSet) IsSubSet(c *BitSet) bool {
+	if len(b.set) == 0 {
+		return true
+	}
+	if c == nil {
+		return false
+	}
+
+	return c.IsSuperSet(b)
+}
+
+// IsStrictSubSet answers `true` if this bitset is a subset of the
+// given bitset, and the given bitset includes at least one additional
+// element.
+func (b *BitSet) IsStrictSubSet(c *BitSet) bool {
+	if !b.IsSubSet(c) || c == nil {
+		return false
+	}
+
+	return popcountSet(b.set) < popcountSet(c.set)
+}
+
+// Intersects answers `true` if this bitset and the given bitset have
+// at least one bit set in common.  It stops at the first such bit,
+// without constructing an intermediate bitset.  A `nil` argument is
+// treated as an empty bitset.
+func (b *BitSet) Intersects(c *BitSet) bool {
+	if c == nil {
+		return false
+	}
+
+	lb, lc := len(b.set), len(c.set)
+	i, j := 0, 0
+	for i < lb && j < lc {
+		bbl := b.set[i]
+		cbl := c.set[j]
+
+		switch {
+		case bbl.Offset < cbl.Offset:
+			i++
+
+		case bbl.Offset == cbl.Offset:
+			if bbl.Bits&cbl.Bits != 0 {
+				return true
+			}
+			i, j = i+1, j+1
+
+		default:
+			j++
+		}
+	}
+
+	return false
+}
+
+// magic identifies the data written by `WriteTo`.  Its first byte is
+// `FormatStandard`.
+var magic = [4]byte{byte(FormatStandard), 'S', 'B', 'S'}
+
+const (
+	// formatVersion is the version of the data written by `WriteTo`.
+	// It follows `magic`.
+	formatVersion = 1
+
+	// headerSize is the size of the header written by `WriteTo`.
+	headerSize = len(magic) + 1
+)
+
 // BinaryStorageSize answers the number of bytes that will be needed
 // to serialise this bitset.
 func (b *BitSet) BinaryStorageSize() int {
+	return headerSize + b.bodySize()
+}
+
+// bodySize answers the number of bytes that will be needed to
+// serialise this bitset, without a header.
+func (b *BitSet) bodySize() int {
 	return binary.Size(uint32(0)) + binary.Size(b.set)
 }
 
-// WriteTo serialises this bitset to the given `io.Writer`.
+// WriteTo serialises this bitset to the given `io.Writer`.  The data
+// begins with a magic number and a format version, followed by its
+// length, and the blocks.
 func (b *BitSet) WriteTo(w io.Writer) (int64, error) {
+	n, err := writeHeader(w)
+	if err != nil {
+		return n, err
+	}
+
+	m, err := b.writeBody(w)
+	return n + m, err
+}
+
+// writeHeader writes the header of the format of `WriteTo` to the
+// given stream.
+func writeHeader(w io.Writer) (int64, error) {
+	var hdr [headerSize]byte
+	copy(hdr[:], magic[:])
+	hdr[len(magic)] = formatVersion
+	n, err := w.Write(hdr[:])
+	return int64(n), err
+}
+
+// writeBody serialises this bitset to the given `io.Writer`, without
+// a header.  This is the format of `FormatLegacy`.
+func (b *BitSet) writeBody(w io.Writer) (int64, error) {
 	var err error
 
 	// Write length of the data to follow.
@@ -928,14 +2881,51 @@ func (b *BitSet) WriteTo(w io.Writer) (int64, error) {
 		return int64(binary.Size(uint32(0))), err
 	}
 
-	return int64(b.BinaryStorageSize()), nil
+	return int64(b.bodySize()), nil
 }
 
-// ReadFrom de-serialises the data from the given `io.Reader` stream
-// into this bitset.
+// readHeader reads the header written by `WriteTo` from the given
+// stream.  It answers `ErrBadMagic` if the stream does not begin with
+// `magic`, and `ErrUnsupportedVersion` if the format version is not
+// `formatVersion`.
+func readHeader(r io.Reader) (int64, error) {
+	var hdr [headerSize]byte
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	if [len(magic)]byte(hdr[:len(magic)]) != magic {
+		return int64(n), ErrBadMagic
+	}
+	if hdr[len(magic)] != formatVersion {
+		return int64(n), ErrUnsupportedVersion
+	}
+	return int64(n), nil
+}
+
+// ReadFrom de-serialises the data written by `WriteTo` from the given
+// `io.Reader` stream into this bitset.  It answers `ErrBadMagic` for
+// data in any other format, and `ErrUnsupportedVersion` for data
+// written by an incompatible version.  Use `ReadAuto` for data in
+// `FormatLegacy`.  If `ValidateOnRead` is `true`, malformed data is
+// rejected, and this bitset is left unchanged.
 //
 // N.B. This method overwrites the data currently in this bitset.
 func (b *BitSet) ReadFrom(r io.Reader) (int64, error) {
+	n, err := readHeader(r)
+	if err != nil {
+		return n, err
+	}
+
+	m, err := b.readBody(r)
+	return n + m, err
+}
+
+// readBody de-serialises data without a header, as written by
+// `writeBody`, from the given stream into this bitset.  Storage grows
+// as blocks are read, so a corrupt length can not force a large
+// allocation.
+func (b *BitSet) readBody(r io.Reader) (int64, error) {
 	var err error
 
 	// Read length of the data that follows.
@@ -944,14 +2934,225 @@ func (b *BitSet) ReadFrom(r io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	total := int64(binary.Size(uint32(0)))
+
+	bsz := uint64(2 * binary.Size(uint64(0)))
+	count := uint64(lb) / bsz
+	set := make(blockAry, 0, min(count, maxHintBlocks))
+	buf := make([]byte, min(count, streamChunkBlocks)*bsz)
+	for count > 0 {
+		k := min(count, streamChunkBlocks)
+		n, err := io.ReadFull(r, buf[:k*bsz])
+		total += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+
+		for p := buf[:n]; len(p) > 0; p = p[bsz:] {
+			set = append(set, block{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])})
+		}
+		count -= k
+	}
+	if ValidateOnRead {
+		if err = (&BitSet{set: set}).Valid(); err != nil {
+			return total, err
+		}
+	}
+
+	b.set = set
+	b.invalidate()
+	return total, nil
+}
+
+// WriteToReverse serialises this bitset to the given `io.Writer`,
+// with its blocks in descending order of offsets.  This suits
+// log-structured storage, in which the most recent (highest) blocks
+// should be read first.  The data is preceded by its format version,
+// and should be de-serialised using `ReadFromReverse`.
+func (b *BitSet) WriteToReverse(w io.Writer) (int64, error) {
+	lb := len(b.set)
+	bsz := 2 * binary.Size(uint64(0))
+
+	buf := make([]byte, 1+binary.Size(uint32(0))+lb*bsz)
+	buf[0] = byte(FormatReversed)
+	binary.BigEndian.PutUint32(buf[1:], uint32(lb*bsz))
+	p := buf[1+binary.Size(uint32(0)):]
+	for i := lb - 1; i >= 0; i-- {
+		binary.BigEndian.PutUint64(p, b.set[i].Offset)
+		binary.BigEndian.PutUint64(p[8:], b.set[i].Bits)
+		p = p[bsz:]
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFromReverse de-serialises the data written by `WriteToReverse`
+// from the given `io.Reader` stream into this bitset, restoring the
+// ascending order of its blocks.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) ReadFromReverse(r io.Reader) (int64, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, err
+	}
+	if Format(hdr[0]) != FormatReversed {
+		return int64(len(hdr)), ErrUnknownFormat
+	}
 
-	n := int(lb) / (2 * binary.Size(uint64(0)))
-	set := make(blockAry, 0, n)
-	err = binary.Read(r, binary.BigEndian, &set)
+	bsz := 2 * binary.Size(uint64(0))
+	n := int(binary.BigEndian.Uint32(hdr[1:])) / bsz
+	buf := make([]byte, n*bsz)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return int64(binary.Size(uint32(0))), err
+		return int64(len(hdr)), err
+	}
+
+	set := make(blockAry, n)
+	for k := range set {
+		p := buf[(n-1-k)*bsz:]
+		set[k] = block{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])}
+		if k > 0 && set[k].Offset <= set[k-1].Offset {
+			return int64(len(hdr) + len(buf)), ErrBlocksOutOfOrder
+		}
+	}
+
+	b.set = set
+	b.invalidate()
+	return int64(len(hdr) + len(buf)), nil
+}
+
+// WriteToChecked serialises this bitset to the given `io.Writer`.  Its
+// format version is followed by the data in the format of `WriteTo`,
+// without its header, and a CRC32 (IEEE) checksum of that data.  It
+// should be de-serialised using `ReadFromChecked`, which detects
+// corruption of the data.
+func (b *BitSet) WriteToChecked(w io.Writer) (int64, error) {
+	_, err := w.Write([]byte{byte(FormatChecked)})
+	if err != nil {
+		return 0, err
+	}
+
+	h := crc32.NewIEEE()
+	n, err := b.writeBody(io.MultiWriter(w, h))
+	n++
+	if err != nil {
+		return n, err
+	}
+
+	err = binary.Write(w, binary.BigEndian, h.Sum32())
+	if err != nil {
+		return n, err
+	}
+	return n + int64(binary.Size(uint32(0))), nil
+}
+
+// ReadFromChecked de-serialises the data written by `WriteToChecked`
+// from the given `io.Reader` stream into this bitset.  It answers
+// `ErrChecksumMismatch` if the data does not match its checksum, in
+// which case this bitset is left unchanged.  The same holds for
+// malformed data, if `ValidateOnRead` is `true`.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) ReadFromChecked(r io.Reader) (int64, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:1])
+	if err != nil {
+		return 0, err
+	}
+	if Format(hdr[0]) != FormatChecked {
+		return 1, ErrUnknownFormat
+	}
+
+	h := crc32.NewIEEE()
+	tr := io.TeeReader(r, h)
+	_, err = io.ReadFull(tr, hdr[1:])
+	if err != nil {
+		return 1, err
+	}
+
+	bsz := 2 * binary.Size(uint64(0))
+	buf := make([]byte, int(binary.BigEndian.Uint32(hdr[1:]))/bsz*bsz)
+	_, err = io.ReadFull(tr, buf)
+	if err != nil {
+		return int64(len(hdr)), err
+	}
+	n := int64(len(hdr) + len(buf))
+
+	var sum uint32
+	err = binary.Read(r, binary.BigEndian, &sum)
+	if err != nil {
+		return n, err
+	}
+	n += int64(binary.Size(sum))
+	if sum != h.Sum32() {
+		return n, ErrChecksumMismatch
+	}
+
+	set := decodeBlocks(buf)
+	if ValidateOnRead {
+		if err = (&BitSet{set: set}).Valid(); err != nil {
+			return n, err
+		}
 	}
 
 	b.set = set
-	return int64(b.BinaryStorageSize()), nil
+	b.invalidate()
+	return n, nil
+}
+
+// decodeBlocks decodes the given serialised blocks.
+func decodeBlocks(buf []byte) blockAry {
+	bsz := 2 * binary.Size(uint64(0))
+	set := make(blockAry, len(buf)/bsz)
+	for k := range set {
+		p := buf[k*bsz:]
+		set[k] = block{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])}
+	}
+	return set
+}
+
+// WindowChecksum is the checksum of a window of blocks, as answered
+// by `WindowChecksums`.  `Window` is the index of the window, i.e. the
+// offset of its first block divided by the window size.
+type WindowChecksum struct {
+	Window uint64
+	Sum    uint32
+}
+
+// WindowChecksums answers a CRC32 (IEEE) checksum for each window of
+// `windowWords` consecutive block offsets that holds any set bits, in
+// ascending order of windows.  Within a window, blocks are
+// checksummed using their offsets relative to the window's start.
+// Therefore, regions that are identical in two bitsets produce
+// matching checksums for their windows.  Empty windows are omitted,
+// so the answer has at most one entry per block.  It answers `nil`
+// when `windowWords` is `0`, or this bitset is empty.
+func (b *BitSet) WindowChecksums(windowWords uint64) []WindowChecksum {
+	lb := len(b.set)
+	if windowWords == 0 || lb == 0 {
+		return nil
+	}
+
+	var res []WindowChecksum
+	var buf [16]byte
+	for i := 0; i < lb; {
+		w := b.set[i].Offset / windowWords
+		start := w * windowWords
+
+		h := crc32.NewIEEE()
+		for ; i < lb && b.set[i].Offset/windowWords == w; i++ {
+			binary.BigEndian.PutUint64(buf[:8], b.set[i].Offset-start)
+			binary.BigEndian.PutUint64(buf[8:], b.set[i].Bits)
+			h.Write(buf[:])
+		}
+		res = append(res, WindowChecksum{w, h.Sum32()})
+	}
+
+	return res
 }
@@ -0,0 +1,156 @@
+// (c) Copyright 2015 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sparsebitset
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const (
+	// streamChunkBlocks is the number of blocks that `WriteBlocksTo`
+	// and `ReadBlocksFrom` encode, or decode, at a time.
+	streamChunkBlocks = 4096
+
+	// openBlockCount is the block count of a stream in
+	// `FormatStreamed` whose length is not known when it is begun.  Its
+	// blocks are terminated by an empty block instead.
+	openBlockCount = uint64(math.MaxUint64)
+)
+
+// WriteBlocksTo serialises this bitset to the given `io.Writer`,
+// without materialising the whole of the data in memory.  Its format
+// version is followed by the number of blocks, as a `uint64`, and the
+// blocks.  Unlike `WriteTo`, whose `uint32` length prefix limits it to
+// 2^28 blocks, it can serialise bitsets of any size.  It should be
+// de-serialised using `ReadBlocksFrom`.
+func (b *BitSet) WriteBlocksTo(w io.Writer) (int64, error) {
+	var hdr [9]byte
+	hdr[0] = byte(FormatStreamed)
+	binary.BigEndian.PutUint64(hdr[1:], uint64(len(b.set)))
+	n, err := w.Write(hdr[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	bsz := 2 * binary.Size(uint64(0))
+	buf := make([]byte, 0, min(len(b.set), streamChunkBlocks)*bsz)
+	for set := b.set; len(set) > 0; {
+		k := min(len(set), streamChunkBlocks)
+		buf = buf[:0]
+		for _, el := range set[:k] {
+			buf = binary.BigEndian.AppendUint64(buf, el.Offset)
+			buf = binary.BigEndian.AppendUint64(buf, el.Bits)
+		}
+		n, err = w.Write(buf)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		set = set[k:]
+	}
+
+	return total, nil
+}
+
+// ReadBlocksFrom de-serialises the data written by `WriteBlocksTo`
+// (or `UnionReaders`) from the given `io.Reader` stream into this
+// bitset.  A block count of `math.MaxUint64` denotes blocks terminated
+// by an empty block, rather than counted.  Storage grows as blocks are
+// read, so a corrupt block count can not force a large allocation.  It answers `ErrBlocksOutOfOrder` or `ErrEmptyBlock` for
+// malformed data.  On error, this bitset is left unchanged.
+//
+// N.B. This method overwrites the data currently in this bitset.
+func (b *BitSet) ReadBlocksFrom(r io.Reader) (int64, error) {
+	var hdr [9]byte
+	n, err := io.ReadFull(r, hdr[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	if Format(hdr[0]) != FormatStreamed {
+		return total, ErrUnknownFormat
+	}
+
+	count := binary.BigEndian.Uint64(hdr[1:])
+	if count == openBlockCount {
+		return b.readOpenBlocks(r, total)
+	}
+	set := make(blockAry, 0, min(count, maxHintBlocks))
+	bsz := 2 * binary.Size(uint64(0))
+	buf := make([]byte, min(count, streamChunkBlocks)*uint64(bsz))
+	for count > 0 {
+		k := min(count, streamChunkBlocks)
+		n, err = io.ReadFull(r, buf[:k*uint64(bsz)])
+		total += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+
+		for p := buf[:n]; len(p) > 0; p = p[bsz:] {
+			el := block{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])}
+			switch {
+			case el.Bits == 0:
+				return total, ErrEmptyBlock
+			case len(set) > 0 && el.Offset <= set[len(set)-1].Offset:
+				return total, ErrBlocksOutOfOrder
+			}
+			set = append(set, el)
+		}
+		count -= k
+	}
+
+	b.set = set
+	b.invalidate()
+	return total, nil
+}
+
+// readOpenBlocks reads blocks from the given stream, up to and
+// including the empty block that terminates them, into this bitset.
+// The given number of bytes has already been read.  Blocks are read
+// one at a time, so that the stream is not consumed beyond the
+// terminator.
+func (b *BitSet) readOpenBlocks(r io.Reader, total int64) (int64, error) {
+	var set blockAry
+	var buf [16]byte
+	for {
+		n, err := io.ReadFull(r, buf[:])
+		total += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+
+		el := block{binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:])}
+		if el.Bits == 0 {
+			break
+		}
+		if len(set) > 0 && el.Offset <= set[len(set)-1].Offset {
+			return total, ErrBlocksOutOfOrder
+		}
+		set = append(set, el)
+	}
+
+	b.set = set
+	b.invalidate()
+	return total, nil
+}